@@ -0,0 +1,474 @@
+package amf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// AMF0Decoder reads AMF0 values into the same Go values Decoder reads AMF3
+// values into. Read into interface{}, objects become *TypedObject, ECMA
+// arrays *ECMAArray and strict arrays []interface{}, so that AMF0Encoder
+// writes them back in the form they were received.
+type AMF0Decoder struct {
+	VerboseLog bool
+
+	TraitsMapper *TraitsMapper
+
+	// Parse strings decoded into integer values, see Decoder.
+	NumericStrings bool
+
+	reader io.Reader
+
+	objectRefs refTable
+}
+
+func NewAMF0Decoder(reader io.Reader) *AMF0Decoder {
+	return &AMF0Decoder{
+		reader: reader,
+	}
+}
+
+func (d *AMF0Decoder) Decode(objptr interface{}) error {
+	return d.ReadValue(objptr)
+}
+
+func (d *AMF0Decoder) GetReader() io.Reader {
+	return d.reader
+}
+
+func (d *AMF0Decoder) ReadUInt8() (uint8, error) {
+	b := []byte{0}
+	_, err := io.ReadFull(d.reader, b)
+	return b[0], err
+}
+
+func (d *AMF0Decoder) ReadUInt16() (uint16, error) {
+	var v uint16
+	err := binary.Read(d.reader, binary.BigEndian, &v)
+	return v, err
+}
+
+func (d *AMF0Decoder) ReadUInt32() (uint32, error) {
+	var v uint32
+	err := binary.Read(d.reader, binary.BigEndian, &v)
+	return v, err
+}
+
+func (d *AMF0Decoder) ReadDouble() (float64, error) {
+	var f float64
+	err := binary.Read(d.reader, binary.BigEndian, &f)
+	return f, err
+}
+
+// ReadString reads a string with a 16-bit length.
+func (d *AMF0Decoder) ReadString() (string, error) {
+	length, err := d.ReadUInt16()
+	if err != nil {
+		return "", err
+	}
+	buf, err := d.readBytes(int(length))
+	return string(buf), err
+}
+
+// ReadLongString reads a string with a 32-bit length.
+func (d *AMF0Decoder) ReadLongString() (string, error) {
+	length, err := d.ReadUInt32()
+	if err != nil {
+		return "", err
+	}
+	buf, err := d.readBytes(int(length))
+	return string(buf), err
+}
+
+func (d *AMF0Decoder) readBytes(length int) ([]byte, error) {
+	return readFull(d.reader, length)
+}
+
+func (d *AMF0Decoder) ReadValue(vptr interface{}) error {
+	marker, err := d.ReadUInt8()
+	if err != nil {
+		return err
+	}
+
+	switch AMF0Marker(marker) {
+	case AMF0MarkerObject:
+		return d.ReadObject(vptr)
+	case AMF0MarkerTypedObject:
+		return d.ReadTypedObject(vptr)
+	case AMF0MarkerECMAArray:
+		return d.ReadECMAArray(vptr)
+	case AMF0MarkerStrictArray:
+		return d.ReadStrictArray(vptr)
+	case AMF0MarkerAVMPlus:
+		return d.ReadAVMPlus(vptr)
+	}
+
+	v := reflect.ValueOf(vptr)
+	if v.Kind() != reflect.Ptr {
+		panic("Must pass a pointer")
+	}
+	if v.IsNil() {
+		v.Set(reflect.New(v.Type().Elem()))
+	}
+	v = v.Elem()
+
+	switch AMF0Marker(marker) {
+	case AMF0MarkerUndefined, AMF0MarkerUnsupported:
+		return setReflectUndefined(v)
+	case AMF0MarkerNull:
+		v.Set(reflect.New(v.Type()).Elem())
+		return nil
+	case AMF0MarkerBoolean:
+		b, err := d.ReadUInt8()
+		if err != nil {
+			return err
+		}
+		return setReflectValue(v, b != 0)
+	case AMF0MarkerNumber:
+		f, err := d.ReadDouble()
+		if err != nil {
+			return err
+		}
+		if isBigNumberType(reflectRemoveTypePtrs(v.Type())) {
+			return setReflectBigNumber(v, f)
+		}
+		return setReflectFloat(v, f)
+	case AMF0MarkerString, AMF0MarkerLongString:
+		var str string
+		if AMF0Marker(marker) == AMF0MarkerString {
+			str, err = d.ReadString()
+		} else {
+			str, err = d.ReadLongString()
+		}
+		if err != nil {
+			return err
+		}
+		if isBigNumberType(reflectRemoveTypePtrs(v.Type())) {
+			return setReflectBigNumber(v, str)
+		}
+		if d.NumericStrings {
+			return setReflectNumericString(v, str)
+		}
+		return setReflectValue(v, str)
+	case AMF0MarkerReference:
+		ref, err := d.ReadUInt16()
+		if err != nil {
+			return err
+		}
+		if val, err := d.objectRefs.Get(int(ref)); err != nil {
+			return err
+		} else {
+			return setReflectValue(v, val)
+		}
+	case AMF0MarkerDate:
+		f, err := d.ReadDouble()
+		if err != nil {
+			return err
+		}
+		var tz int16
+		if err := binary.Read(d.reader, binary.BigEndian, &tz); err != nil {
+			return err
+		}
+		// Time zone is the offset from UTC in minutes, and usually 0
+		t := millisToTime(f)
+		if tz != 0 {
+			t = t.In(time.FixedZone("", int(tz)*60))
+		}
+		return setReflectValue(v, t)
+	case AMF0MarkerXMLDoc:
+		str, err := d.ReadLongString()
+		if err != nil {
+			return err
+		}
+		return setXMLValue(v, XMLDocument(str))
+	}
+
+	return fmt.Errorf("Unhandled marker: %d", marker)
+}
+
+// ReadAVMPlus reads a value in AMF3 following the avmplus marker. Each value
+// starts with empty reference tables.
+func (d *AMF0Decoder) ReadAVMPlus(vptr interface{}) error {
+	dec := NewDecoder(d.reader)
+	dec.VerboseLog = d.VerboseLog
+	dec.TraitsMapper = d.TraitsMapper
+	dec.NumericStrings = d.NumericStrings
+	return dec.ReadValue(vptr)
+}
+
+// ReadObject reads an anonymous object.
+func (d *AMF0Decoder) ReadObject(vptr interface{}) error {
+	return d.readObject(vptr, "")
+}
+
+// ReadTypedObject reads the class name and members of a typed object.
+func (d *AMF0Decoder) ReadTypedObject(vptr interface{}) error {
+	cls, err := d.ReadString()
+	if err != nil {
+		return err
+	}
+	return d.readObject(vptr, cls)
+}
+
+func (d *AMF0Decoder) readObject(vptr interface{}, className string) error {
+	v := reflect.ValueOf(vptr)
+	if v.Kind() != reflect.Ptr {
+		return fmt.Errorf("vptr must be a pointer")
+	}
+	v, err := prepareObject(d, v.Elem(), className)
+	if err != nil {
+		return err
+	}
+	if err := checkMembersTarget(v.Type()); err != nil {
+		return err
+	}
+	d.logPrintln("ReadObject class", className, "into", v.Type())
+
+	// Add the object before reading the members, so that members referring
+	// back to it get the object being populated
+	d.objectRefs.Add(v.Addr().Interface())
+
+	if tobj, ok := v.Addr().Interface().(*TypedObject); ok {
+		// All members are dynamic, their order is kept in DynamicKeys
+		tobj.Traits = &Traits{ClassName: className, Dynamic: true}
+		if tobj.Assoc == nil {
+			tobj.Assoc = make(map[string]interface{})
+		}
+		return d.readProperties(func(key string) error {
+			var val interface{}
+			if err := d.ReadValue(&val); err != nil {
+				return err
+			}
+			d.logPrintln("Read key", key, "value", val)
+			tobj.Assoc[key] = val
+			tobj.DynamicKeys = append(tobj.DynamicKeys, key)
+			return nil
+		})
+	}
+
+	return d.readProperties(func(key string) error {
+		if ignored, err := readObjectField(d, v, key); err != nil {
+			return err
+		} else if ignored {
+			d.logPrintln("ignore key", key, "in class", className)
+		}
+		return nil
+	})
+}
+
+// readProperties calls readValue for each key until the object end marker.
+func (d *AMF0Decoder) readProperties(readValue func(key string) error) error {
+	for {
+		key, err := d.ReadString()
+		if err != nil {
+			return err
+		}
+		if len(key) == 0 {
+			marker, err := d.ReadUInt8()
+			if err != nil {
+				return err
+			}
+			if AMF0Marker(marker) != AMF0MarkerObjectEnd {
+				return fmt.Errorf("Expect object end marker, got %d", marker)
+			}
+			return nil
+		}
+		if err := readValue(key); err != nil {
+			return err
+		}
+	}
+}
+
+// ReadECMAArray reads an associative array. The count sent is only a hint,
+// members are read until the object end marker.
+func (d *AMF0Decoder) ReadECMAArray(vptr interface{}) error {
+	v := reflect.ValueOf(vptr)
+	if v.Kind() != reflect.Ptr {
+		return fmt.Errorf("vptr must be a pointer")
+	}
+	v = v.Elem()
+
+	count, err := d.ReadUInt32()
+	if err != nil {
+		return err
+	}
+
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	switch tobj := v.Addr().Interface().(type) {
+	case *TypedObject:
+		if tobj.Assoc == nil {
+			tobj.Assoc = make(map[string]interface{})
+		}
+		d.objectRefs.Add(tobj)
+		return d.readProperties(func(key string) error {
+			var val interface{}
+			if err := d.ReadValue(&val); err != nil {
+				return err
+			}
+			tobj.Assoc[key] = val
+			return nil
+		})
+	case *ECMAArray:
+		d.objectRefs.Add(tobj)
+		return d.readECMAArrayAssoc(tobj, count)
+	}
+
+	d.logPrintln("ReadECMAArray to", v.Type())
+	switch v.Kind() {
+	case reflect.Interface:
+		arr := &ECMAArray{}
+		d.objectRefs.Add(arr)
+		v.Set(reflect.ValueOf(arr))
+		return d.readECMAArrayAssoc(arr, count)
+
+	case reflect.Map:
+		if err := checkMembersTarget(v.Type()); err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		d.objectRefs.Add(v.Interface())
+		return d.readProperties(func(key string) error {
+			_, err := readObjectField(d, v, key)
+			return err
+		})
+
+	case reflect.Slice:
+		// Index keys are read into the elements, the slice grows to the keys
+		// read as the count is only a hint. Sparse indexes far beyond the
+		// keys read are ignored.
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+		d.objectRefs.Add(v.Addr().Interface())
+		nkeys := 0
+		return d.readProperties(func(key string) error {
+			nkeys++
+			if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < nkeys+maxPrealloc {
+				if n := i + 1 - v.Len(); n > 0 {
+					v.Set(reflect.AppendSlice(v, reflect.MakeSlice(v.Type(), n, n)))
+				}
+				return d.ReadValue(v.Index(i).Addr().Interface())
+			}
+			d.logPrintln("Ignore key", key)
+			var dummy interface{}
+			return d.ReadValue(&dummy)
+		})
+
+	case reflect.Struct:
+		v.Set(reflect.Zero(v.Type()))
+		d.objectRefs.Add(v.Addr().Interface())
+		return d.readProperties(func(key string) error {
+			if ignored, err := readObjectField(d, v, key); err != nil {
+				return err
+			} else if ignored {
+				d.logPrintln("Ignore key", key)
+			}
+			return nil
+		})
+	}
+
+	return fmt.Errorf("Cannot read ECMA array into %s", v.Type())
+}
+
+func (d *AMF0Decoder) readECMAArrayAssoc(arr *ECMAArray, count uint32) error {
+	arr.Assoc, arr.Dense, arr.Count = nil, nil, &count
+	return d.readProperties(func(key string) error {
+		entry := ECMAArrayEntry{Key: key}
+		if err := d.ReadValue(&entry.Value); err != nil {
+			return err
+		}
+		arr.Assoc = append(arr.Assoc, entry)
+		return nil
+	})
+}
+
+// ReadStrictArray reads an array of values with a 32-bit count.
+func (d *AMF0Decoder) ReadStrictArray(vptr interface{}) error {
+	v := reflect.ValueOf(vptr)
+	if v.Kind() != reflect.Ptr {
+		return fmt.Errorf("vptr must be a pointer")
+	}
+	v = v.Elem()
+
+	length, err := d.ReadUInt32()
+	if err != nil {
+		return err
+	}
+
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	switch tobj := v.Addr().Interface().(type) {
+	case *TypedObject:
+		d.objectRefs.Add(tobj)
+		return d.readStrictArrayElements(reflect.ValueOf(&tobj.Array).Elem(), int(length))
+	case *ECMAArray:
+		d.objectRefs.Add(tobj)
+		return d.readStrictArrayElements(reflect.ValueOf(&tobj.Dense).Elem(), int(length))
+	}
+
+	d.logPrintln("ReadStrictArray to", v.Type())
+	switch v.Kind() {
+	case reflect.Interface:
+		var dense []interface{}
+		d.objectRefs.Add(&dense)
+		err := d.readStrictArrayElements(reflect.ValueOf(&dense).Elem(), int(length))
+		v.Set(reflect.ValueOf(dense))
+		return err
+
+	case reflect.Slice:
+		// Keep a pointer so that references see the elements read later
+		d.objectRefs.Add(v.Addr().Interface())
+		return d.readStrictArrayElements(v, int(length))
+	}
+
+	return fmt.Errorf("Cannot read strict array into %s", v.Type())
+}
+
+// readStrictArrayElements reads length elements into the slice v. Elements
+// are allocated in chunks as they arrive, the count is not trusted for
+// allocation.
+func (d *AMF0Decoder) readStrictArrayElements(v reflect.Value, length int) error {
+	v.Set(reflect.MakeSlice(v.Type(), preallocLen(length), preallocLen(length)))
+	for i := 0; i < length; i++ {
+		if i == v.Len() {
+			n := preallocLen(length - i)
+			v.Set(reflect.AppendSlice(v, reflect.MakeSlice(v.Type(), n, n)))
+		}
+		if err := d.ReadValue(v.Index(i).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *AMF0Decoder) getTraitsMapper() *TraitsMapper {
+	if d.TraitsMapper != nil {
+		return d.TraitsMapper
+	}
+	return DefaultTraitsMapper
+}
+
+func (d *AMF0Decoder) createObject(className string) interface{} {
+	return newMappedObject(d.getTraitsMapper(), className)
+}
+
+func (d *AMF0Decoder) logPrintln(objs ...interface{}) {
+	if d.VerboseLog || Debug {
+		fmt.Println(objs...)
+	}
+}
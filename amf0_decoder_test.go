@@ -0,0 +1,70 @@
+package amf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAMF0DecodeMembersInvalidTarget(t *testing.T) {
+	object := []byte{
+		0x03,
+		0x00, 0x01, 'a', 0x02, 0x00, 0x01, 'x',
+		0x00, 0x00, 0x09,
+	}
+	ecmaArray := []byte{
+		0x08, 0x00, 0x00, 0x00, 0x01,
+		0x00, 0x01, '0', 0x02, 0x00, 0x01, 'x',
+		0x00, 0x00, 0x09,
+	}
+	for _, c := range []struct {
+		data []byte
+		vptr interface{}
+	}{
+		{object, new(int)},
+		{object, new(map[int]string)},
+		{ecmaArray, new(map[int]string)},
+		{ecmaArray, new(int)},
+	} {
+		if err := NewAMF0Decoder(bytes.NewReader(c.data)).ReadValue(c.vptr); err == nil {
+			t.Errorf("Decoded % x into %T without error", c.data, c.vptr)
+		}
+	}
+
+	// Maps with keys of a string type are fine
+	type key string
+	var m map[key]string
+	if err := NewAMF0Decoder(bytes.NewReader(ecmaArray)).ReadValue(&m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || m["0"] != "x" {
+		t.Errorf("Decoded %#v", m)
+	}
+}
+
+func TestAMF0DecodeAVMPlusReferences(t *testing.T) {
+	// Each switched value starts with empty reference tables, so both send
+	// the string inline before referring to it
+	data := []byte{
+		0x0a, 0x00, 0x00, 0x00, 0x02,
+		0x11, 0x09, 0x05, 0x01, 0x06, 0x05, 'a', 'b', 0x06, 0x00,
+		0x11, 0x09, 0x05, 0x01, 0x06, 0x05, 'c', 'd', 0x06, 0x00,
+	}
+	var out [][]string
+	if err := NewAMF0Decoder(bytes.NewReader(data)).ReadValue(&out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || len(out[0]) != 2 || out[0][1] != "ab" || len(out[1]) != 2 || out[1][1] != "cd" {
+		t.Errorf("Decoded %q", out)
+	}
+
+	// A reference to the array of the previous switched value
+	data = []byte{
+		0x0a, 0x00, 0x00, 0x00, 0x02,
+		0x11, 0x09, 0x01, 0x01,
+		0x11, 0x09, 0x00,
+	}
+	var v interface{}
+	if err := NewAMF0Decoder(bytes.NewReader(data)).ReadValue(&v); err == nil {
+		t.Errorf("Decoded %#v, expect a reference error", v)
+	}
+}
@@ -0,0 +1,492 @@
+package amf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Object encodings, the AMF version values are written in
+const (
+	ObjectEncodingAMF0 = 0
+	ObjectEncodingAMF3 = 3
+)
+
+// AMF0Encoder writes Go values in AMF0 format. Registered structs are
+// written as typed objects, other structs as anonymous objects. Slices are
+// written as strict arrays, ECMAArray as ECMA arrays and TypedObject as
+// anonymous or typed objects by its class name.
+type AMF0Encoder struct {
+	VerboseLog bool
+
+	TraitsMapper *TraitsMapper
+
+	// Write string-keyed maps as ECMA arrays instead of anonymous objects.
+	MapsAsArrays bool
+
+	// Write slices of registered types as Vector.<T> in AMF3 values, see
+	// Encoder.
+	ObjectVectors bool
+
+	// Write nil slices as empty arrays instead of null.
+	NilSlicesAsEmptyArrays bool
+
+	// How to write integers beyond the precision of a double.
+	LargeIntegers IntegerPolicy
+
+	// Write values in AMF3 after the avmplus marker if set to
+	// ObjectEncodingAMF3.
+	ObjectEncoding int
+
+	writer io.Writer
+
+	objectRefs objectRefIndex
+}
+
+func NewAMF0Encoder(writer io.Writer) *AMF0Encoder {
+	return &AMF0Encoder{
+		writer: writer,
+	}
+}
+
+func (e *AMF0Encoder) Encode(obj interface{}) error {
+	return e.WriteValue(obj)
+}
+
+func (e *AMF0Encoder) WriteUInt8(v uint8) error {
+	_, err := e.writer.Write([]byte{byte(v)})
+	return err
+}
+
+func (e *AMF0Encoder) WriteUInt16(v uint16) error {
+	return binary.Write(e.writer, binary.BigEndian, v)
+}
+
+func (e *AMF0Encoder) WriteUInt32(v uint32) error {
+	return binary.Write(e.writer, binary.BigEndian, v)
+}
+
+func (e *AMF0Encoder) WriteDouble(f float64) error {
+	return binary.Write(e.writer, binary.BigEndian, f)
+}
+
+// WriteString writes a string with a 16-bit length.
+func (e *AMF0Encoder) WriteString(str string) error {
+	if len(str) > math.MaxUint16 {
+		return fmt.Errorf("String of %d bytes is too long", len(str))
+	}
+	if err := e.WriteUInt16(uint16(len(str))); err != nil {
+		return err
+	}
+	_, err := e.writer.Write([]byte(str))
+	return err
+}
+
+// WriteLongString writes a string with a 32-bit length.
+func (e *AMF0Encoder) WriteLongString(str string) error {
+	if err := e.WriteUInt32(uint32(len(str))); err != nil {
+		return err
+	}
+	_, err := e.writer.Write([]byte(str))
+	return err
+}
+
+func (e *AMF0Encoder) writeMarker(marker AMF0Marker) error {
+	return e.WriteUInt8(uint8(marker))
+}
+
+func (e *AMF0Encoder) WriteValue(vif interface{}) error {
+	if e.ObjectEncoding == ObjectEncodingAMF3 {
+		return e.WriteAVMPlus(vif)
+	}
+
+	v := reflect.ValueOf(vif)
+	for v.IsValid() && (v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr) {
+		v = v.Elem()
+	}
+	if !v.IsValid() || (v.Kind() == reflect.Slice && v.IsNil() && !e.NilSlicesAsEmptyArrays) {
+		return e.writeMarker(AMF0MarkerNull)
+	}
+
+	if isBigNumberType(v.Type()) {
+		return e.WriteValue(bigNumberValue(v, false))
+	}
+
+	if v.CanInterface() {
+		switch x := v.Interface().(type) {
+		case AMF3Undefined:
+			return e.writeMarker(AMF0MarkerUndefined)
+		case AMF3Null:
+			return e.writeMarker(AMF0MarkerNull)
+		case XML:
+			if err := e.writeMarker(AMF0MarkerXMLDoc); err != nil {
+				return err
+			}
+			return e.WriteLongString(string(x))
+		case XMLDocument:
+			if err := e.writeMarker(AMF0MarkerXMLDoc); err != nil {
+				return err
+			}
+			return e.WriteLongString(string(x))
+		case VectorInt:
+			return e.WriteValue(x.Values)
+		case VectorUInt:
+			return e.WriteValue(x.Values)
+		case VectorDouble:
+			return e.WriteValue(x.Values)
+		case VectorObject:
+			return e.WriteValue(x.Values)
+		case ECMAArray:
+			return e.writeECMAArray(v, x)
+		case Dictionary:
+			return errors.New("Dictionary cannot be written in AMF0")
+		case TypedObject:
+			return e.writeTypedObject(v, x)
+		case time.Time:
+			if err := e.writeMarker(AMF0MarkerDate); err != nil {
+				return err
+			}
+			return e.WriteDate(x)
+		}
+	}
+
+	const maxExact = 1 << 53
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if err := e.writeMarker(AMF0MarkerBoolean); err != nil {
+			return err
+		}
+		if v.Bool() {
+			return e.WriteUInt8(1)
+		}
+		return e.WriteUInt8(0)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := v.Int()
+		f, exact := intToDouble(i)
+		if i > maxExact || i < -maxExact {
+			return e.writeLargeInteger(f, exact, strconv.FormatInt(i, 10))
+		}
+		return e.writeNumber(f)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i := v.Uint()
+		f, exact := uintToDouble(i)
+		if i > maxExact {
+			return e.writeLargeInteger(f, exact, strconv.FormatUint(i, 10))
+		}
+		return e.writeNumber(f)
+
+	case reflect.Float32, reflect.Float64:
+		return e.writeNumber(v.Float())
+
+	case reflect.String:
+		return e.writeStringValue(v.String())
+
+	case reflect.Slice, reflect.Array:
+		return e.writeStrictArray(v)
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("Map with %s keys cannot be written in AMF0", v.Type().Key())
+		}
+		if e.MapsAsArrays {
+			return e.writeMapECMAArray(v)
+		}
+		return e.writeMapObject(v)
+
+	case reflect.Struct:
+		return e.WriteObject(vif)
+
+	default:
+		return fmt.Errorf("Unhandled kind: %v", v.Kind())
+	}
+}
+
+// WriteAVMPlus writes the avmplus marker and the value in AMF3. Each value
+// starts with empty reference tables.
+func (e *AMF0Encoder) WriteAVMPlus(vif interface{}) error {
+	if err := e.writeMarker(AMF0MarkerAVMPlus); err != nil {
+		return err
+	}
+	enc := NewEncoder(e.writer)
+	enc.VerboseLog = e.VerboseLog
+	enc.TraitsMapper = e.TraitsMapper
+	enc.MapsAsArrays = e.MapsAsArrays
+	enc.ObjectVectors = e.ObjectVectors
+	enc.NilSlicesAsEmptyArrays = e.NilSlicesAsEmptyArrays
+	enc.LargeIntegers = e.LargeIntegers
+	return enc.WriteValue(vif)
+}
+
+func (e *AMF0Encoder) writeNumber(f float64) error {
+	if err := e.writeMarker(AMF0MarkerNumber); err != nil {
+		return err
+	}
+	return e.WriteDouble(f)
+}
+
+// writeStringValue writes str as a string, or as a long string if its
+// length does not fit in 16 bits.
+func (e *AMF0Encoder) writeStringValue(str string) error {
+	if len(str) > math.MaxUint16 {
+		if err := e.writeMarker(AMF0MarkerLongString); err != nil {
+			return err
+		}
+		return e.WriteLongString(str)
+	}
+	if err := e.writeMarker(AMF0MarkerString); err != nil {
+		return err
+	}
+	return e.WriteString(str)
+}
+
+// writeLargeInteger writes an integer beyond 2^53 as a number, or as decided
+// by LargeIntegers if the double f is not exact.
+func (e *AMF0Encoder) writeLargeInteger(f float64, exact bool, str string) error {
+	val, err := largeIntegerValue(e.LargeIntegers, f, exact, str, e.logPrintln)
+	if err != nil {
+		return err
+	}
+	return e.WriteValue(val)
+}
+
+// WriteDate writes the body of a date. The time zone is always written as 0.
+func (e *AMF0Encoder) WriteDate(t time.Time) error {
+	if err := e.WriteDouble(timeToMillis(t)); err != nil {
+		return err
+	}
+	return e.WriteUInt16(0)
+}
+
+// writeObjectRef writes a reference marker and returns true if the object of
+// v has been written before. Otherwise v is added to the object reference
+// table. References are 16-bit, later objects are written again.
+func (e *AMF0Encoder) writeObjectRef(v reflect.Value) (bool, error) {
+	if ref, ok := e.objectRefs.findOrAdd(0, v, math.MaxUint16); ok {
+		e.logPrintln("Write object using ref", ref)
+		if err := e.writeMarker(AMF0MarkerReference); err != nil {
+			return true, err
+		}
+		return true, e.WriteUInt16(uint16(ref))
+	}
+	return false, nil
+}
+
+func (e *AMF0Encoder) writeStrictArray(v reflect.Value) error {
+	if ok, err := e.writeObjectRef(v); ok || err != nil {
+		return err
+	}
+	if err := e.writeMarker(AMF0MarkerStrictArray); err != nil {
+		return err
+	}
+	if err := e.WriteUInt32(uint32(v.Len())); err != nil {
+		return err
+	}
+	for i := 0; i < v.Len(); i++ {
+		if err := e.WriteValue(v.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeECMAArray writes both parts of arr as an ECMA array, elements of the
+// dense part are keyed by their index. The count read is written back if
+// arr was decoded from AMF0.
+func (e *AMF0Encoder) writeECMAArray(v reflect.Value, arr ECMAArray) error {
+	if ok, err := e.writeObjectRef(v); ok || err != nil {
+		return err
+	}
+	if err := e.writeMarker(AMF0MarkerECMAArray); err != nil {
+		return err
+	}
+	count := uint32(len(arr.Assoc) + len(arr.Dense))
+	if arr.Count != nil {
+		count = *arr.Count
+	}
+	if err := e.WriteUInt32(count); err != nil {
+		return err
+	}
+	for _, entry := range arr.Assoc {
+		if err := e.writeProperty(entry.Key, entry.Value); err != nil {
+			return err
+		}
+	}
+	for i, el := range arr.Dense {
+		if err := e.writeProperty(strconv.Itoa(i), el); err != nil {
+			return err
+		}
+	}
+	return e.writeObjectEnd()
+}
+
+func (e *AMF0Encoder) writeMapECMAArray(v reflect.Value) error {
+	if ok, err := e.writeObjectRef(v); ok || err != nil {
+		return err
+	}
+	if err := e.writeMarker(AMF0MarkerECMAArray); err != nil {
+		return err
+	}
+	if err := e.WriteUInt32(uint32(v.Len())); err != nil {
+		return err
+	}
+	if err := e.writeMapProperties(v); err != nil {
+		return err
+	}
+	return e.writeObjectEnd()
+}
+
+func (e *AMF0Encoder) writeMapObject(v reflect.Value) error {
+	if ok, err := e.writeObjectRef(v); ok || err != nil {
+		return err
+	}
+	if err := e.writeMarker(AMF0MarkerObject); err != nil {
+		return err
+	}
+	if err := e.writeMapProperties(v); err != nil {
+		return err
+	}
+	return e.writeObjectEnd()
+}
+
+func (e *AMF0Encoder) writeMapProperties(v reflect.Value) error {
+	for _, key := range sortedMapKeys(v) {
+		if err := e.writeProperty(key.String(), v.MapIndex(key).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *AMF0Encoder) writeProperty(key string, value interface{}) error {
+	if key == "" {
+		return errors.New("Empty string cannot be used as key")
+	}
+	if err := e.WriteString(key); err != nil {
+		return err
+	}
+	return e.WriteValue(value)
+}
+
+func (e *AMF0Encoder) writeObjectEnd() error {
+	if err := e.WriteString(""); err != nil {
+		return err
+	}
+	return e.writeMarker(AMF0MarkerObjectEnd)
+}
+
+// writeObjectHeader writes the marker of an object, and the class name of
+// typed objects.
+func (e *AMF0Encoder) writeObjectHeader(className string) error {
+	if className == "" {
+		return e.writeMarker(AMF0MarkerObject)
+	}
+	if err := e.writeMarker(AMF0MarkerTypedObject); err != nil {
+		return err
+	}
+	return e.WriteString(className)
+}
+
+func (e *AMF0Encoder) writeTypedObject(v reflect.Value, tobj TypedObject) error {
+	if ok, err := e.writeObjectRef(v); ok || err != nil {
+		return err
+	}
+
+	traits := tobj.Traits
+	if traits == nil {
+		traits = &Traits{Dynamic: true}
+	}
+	if err := e.writeObjectHeader(traits.ClassName); err != nil {
+		return err
+	}
+	for _, key := range traits.Members {
+		if err := e.writeProperty(key, tobj.Assoc[key]); err != nil {
+			return err
+		}
+	}
+	for _, key := range typedObjectDynamicKeys(tobj, traits) {
+		if err := e.writeProperty(key, tobj.Assoc[key]); err != nil {
+			return err
+		}
+	}
+	return e.writeObjectEnd()
+}
+
+// WriteObject writes a struct as a typed object if its type is registered to
+// the TraitsMapper, or as an anonymous object otherwise.
+func (e *AMF0Encoder) WriteObject(vif interface{}) error {
+	v := reflect.ValueOf(vif)
+	for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		panic("Must be a struct")
+	}
+
+	if tobj, ok := v.Interface().(TypedObject); ok {
+		return e.writeTypedObject(v, tobj)
+	}
+
+	members, dynamics := getStructMembersAndDynamics(v)
+	var className string
+	if dt := e.getTraitsMapper().FindByReflectType(v.Type()); dt != nil {
+		if dt.Traits.External {
+			return fmt.Errorf("External object cannot be written in AMF0: class=%s", dt.Traits.ClassName)
+		}
+		className = dt.Traits.ClassName
+		members = dt.Traits.Members
+		if !dt.Traits.Dynamic {
+			dynamics = nil
+		}
+	}
+
+	if ok, err := e.writeObjectRef(v); ok || err != nil {
+		return err
+	}
+	if err := e.writeObjectHeader(className); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(members)+len(dynamics))
+	for _, key := range append(append(keys, members...), dynamics...) {
+		field, sf := findStructFieldByName(v, key)
+
+		var fif interface{} = nil
+		if field.IsValid() {
+			fif = field.Interface()
+		}
+
+		if err := e.WriteString(key); err != nil {
+			return err
+		}
+		if err := e.writeFieldValue(fif, sf.Tag); err != nil {
+			return err
+		}
+	}
+	return e.writeObjectEnd()
+}
+
+// writeFieldValue writes the value of a struct field, honoring the options
+// in the field tag.
+func (e *AMF0Encoder) writeFieldValue(fif interface{}, tag reflect.StructTag) error {
+	return e.WriteValue(fieldValue(fif, tag))
+}
+
+func (e *AMF0Encoder) getTraitsMapper() *TraitsMapper {
+	if e.TraitsMapper != nil {
+		return e.TraitsMapper
+	}
+	return DefaultTraitsMapper
+}
+
+func (e *AMF0Encoder) logPrintln(objs ...interface{}) {
+	if e.VerboseLog || Debug {
+		fmt.Println(objs...)
+	}
+}
@@ -0,0 +1,68 @@
+package amf
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// testAMF0RoundTrip decodes data into an interface and checks that encoding
+// it again with objectEncoding gives the same bytes.
+func testAMF0RoundTrip(t *testing.T, data []byte, objectEncoding int) {
+	var v interface{}
+	if err := NewAMF0Decoder(bytes.NewReader(data)).ReadValue(&v); err != nil {
+		t.Fatalf("Cannot decode % x: %v", data, err)
+	}
+	buf := &bytes.Buffer{}
+	enc := NewAMF0Encoder(buf)
+	enc.ObjectEncoding = objectEncoding
+	if err := enc.WriteValue(v); err != nil {
+		t.Fatalf("Cannot encode %#v: %v", v, err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Round trip of % x gives % x", data, buf.Bytes())
+	}
+}
+
+func TestAMF0RoundTripReferences(t *testing.T) {
+	// Strict array of an object, a reference to it and a reference to the
+	// array. References: 0 array, 1 object.
+	data := []byte{
+		0x0a, 0x00, 0x00, 0x00, 0x03,
+		0x03, 0x00, 0x01, 'a', 0x00, 0x3f, 0xf0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09,
+		0x07, 0x00, 0x01,
+		0x07, 0x00, 0x00,
+	}
+	testAMF0RoundTrip(t, data, 0)
+}
+
+func TestAMF0RoundTripLongString(t *testing.T) {
+	str := strings.Repeat("x", 1<<16)
+	data := append([]byte{0x0c, 0x00, 0x01, 0x00, 0x00}, str...)
+	testAMF0RoundTrip(t, data, 0)
+
+	// Shorter strings are written in the short form
+	buf := &bytes.Buffer{}
+	if err := NewAMF0Encoder(buf).WriteValue(str[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if b := buf.Bytes(); b[0] != 0x02 || len(b) != 3+len(str)-1 {
+		t.Errorf("Wrote % x... of %d bytes", b[:3], len(b))
+	}
+}
+
+func TestAMF0RoundTripECMAArrayCount(t *testing.T) {
+	// Count 0 as sent by some producers, with two entries
+	data := []byte{
+		0x08, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x01, '0', 0x02, 0x00, 0x01, 'x',
+		0x00, 0x01, 'k', 0x01, 0x01,
+		0x00, 0x00, 0x09,
+	}
+	testAMF0RoundTrip(t, data, 0)
+}
+
+func TestAMF0RoundTripAVMPlus(t *testing.T) {
+	// AMF3 array of a string and a reference to it
+	testAMF0RoundTrip(t, []byte{0x11, 0x09, 0x05, 0x01, 0x06, 0x05, 'a', 'b', 0x06, 0x00}, ObjectEncodingAMF3)
+}
@@ -0,0 +1,138 @@
+package amf
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+)
+
+var (
+	bigIntType   = reflect.TypeOf(big.Int{})
+	bigFloatType = reflect.TypeOf(big.Float{})
+	bigRatType   = reflect.TypeOf(big.Rat{})
+)
+
+func isBigNumberType(t reflect.Type) bool {
+	return t == bigIntType || t == bigFloatType || t == bigRatType
+}
+
+// formatBigNumber returns the decimal string and the nearest double of a
+// math/big number.
+func formatBigNumber(v reflect.Value) (str string, f float64) {
+	if !v.CanAddr() {
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		v = p.Elem()
+	}
+	switch n := v.Addr().Interface().(type) {
+	case *big.Int:
+		f, _ = new(big.Float).SetInt(n).Float64()
+		return n.String(), f
+	case *big.Float:
+		f, _ = n.Float64()
+		return n.Text('g', -1), f
+	case *big.Rat:
+		f, _ = n.Float64()
+		return formatBigRat(n), f
+	}
+	panic("Not a big number")
+}
+
+// bigNumberValue returns the value to write for a math/big number, its
+// decimal string, or its nearest double if asDouble is set.
+func bigNumberValue(v reflect.Value, asDouble bool) interface{} {
+	str, f := formatBigNumber(v)
+	if asDouble {
+		return f
+	}
+	return str
+}
+
+// formatBigRat formats r as an exact decimal if it has a finite expansion,
+// like BigDecimal values do. Others are rounded to 34 digits.
+func formatBigRat(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	twos, fives := 0, 0
+	denom := new(big.Int).Set(r.Denom())
+	two, five, mod := big.NewInt(2), big.NewInt(5), new(big.Int)
+	for mod.Mod(denom, two).Sign() == 0 {
+		denom.Quo(denom, two)
+		twos++
+	}
+	for mod.Mod(denom, five).Sign() == 0 {
+		denom.Quo(denom, five)
+		fives++
+	}
+	if denom.Cmp(big.NewInt(1)) != 0 {
+		return r.FloatString(34)
+	}
+	if twos > fives {
+		return r.FloatString(twos)
+	}
+	return r.FloatString(fives)
+}
+
+// setReflectBigNumber sets a decoded integer, double or string to a math/big
+// number, failing with RangeError if it cannot be represented exactly.
+func setReflectBigNumber(dst reflect.Value, val interface{}) error {
+	for dst.Kind() == reflect.Ptr {
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		dst = dst.Elem()
+	}
+
+	if f, ok := val.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return &RangeError{f, dst.Type()}
+	}
+
+	switch n := dst.Addr().Interface().(type) {
+	case *big.Int:
+		switch x := val.(type) {
+		case int32:
+			n.SetInt64(int64(x))
+		case float64:
+			if x != math.Trunc(x) {
+				return &RangeError{x, dst.Type()}
+			}
+			new(big.Float).SetFloat64(x).Int(n)
+		case string:
+			r, ok := new(big.Rat).SetString(x)
+			if !ok {
+				return fmt.Errorf("Cannot parse %q as %s", x, dst.Type())
+			}
+			if !r.IsInt() {
+				return &RangeError{x, dst.Type()}
+			}
+			n.Set(r.Num())
+		}
+	case *big.Float:
+		switch x := val.(type) {
+		case int32:
+			n.SetInt64(int64(x))
+		case float64:
+			n.SetFloat64(x)
+		case string:
+			if _, ok := n.SetString(x); !ok {
+				return fmt.Errorf("Cannot parse %q as %s", x, dst.Type())
+			}
+		}
+	case *big.Rat:
+		switch x := val.(type) {
+		case int32:
+			n.SetInt64(int64(x))
+		case float64:
+			n.SetFloat64(x)
+		case string:
+			if _, ok := n.SetString(x); !ok {
+				return fmt.Errorf("Cannot parse %q as %s", x, dst.Type())
+			}
+		}
+	default:
+		return fmt.Errorf("Cannot set type %T to %s", val, dst.Type())
+	}
+	return nil
+}
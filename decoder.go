@@ -1,11 +1,13 @@
 package amf
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"reflect"
-	"time"
+	"strconv"
 )
 
 type Decoder struct {
@@ -13,6 +15,10 @@ type Decoder struct {
 
 	TraitsMapper *TraitsMapper
 
+	// Parse strings decoded into integer values, for integers sent as
+	// strings to keep their precision.
+	NumericStrings bool
+
 	reader io.Reader
 
 	stringRefs refTable
@@ -24,6 +30,14 @@ type ExternalizeReadable interface {
 	ReadExternal(d *Decoder) error
 }
 
+// valueReader is the part of Decoder and AMF0Decoder shared by the helpers
+// reading objects into Go values.
+type valueReader interface {
+	ReadValue(vptr interface{}) error
+	createObject(className string) interface{}
+	logPrintln(objs ...interface{})
+}
+
 func NewDecoder(reader io.Reader) *Decoder {
 	return &Decoder{
 		reader: reader,
@@ -64,6 +78,18 @@ func (d *Decoder) ReadUInt29() (uint32, error) {
 	return v, err
 }
 
+// ReadInt29 reads a U29 and sign-extends it to a 29-bit signed integer.
+func (d *Decoder) ReadInt29() (int32, error) {
+	v, err := d.ReadUInt29()
+	if err != nil {
+		return 0, err
+	}
+	if v&0x10000000 != 0 {
+		return int32(v) - 0x20000000, nil
+	}
+	return int32(v), nil
+}
+
 func (d *Decoder) ReadString() (string, error) {
 	length, err := d.ReadUInt29()
 	if err != nil {
@@ -76,18 +102,42 @@ func (d *Decoder) ReadString() (string, error) {
 			return v.(string), nil
 		}
 	}
-	length >>= 1
-	buf := make([]byte, length, length)
-	if read, err := d.reader.Read(buf); err != nil || uint32(read) < length {
-		return "", fmt.Errorf("Cannot read %d byte from reader", length)
+	buf, err := d.readBytes(int(length >> 1))
+	if err != nil {
+		return "", err
 	}
 	str := string(buf)
-	if length > 0 {
+	if len(buf) > 0 {
 		d.stringRefs.Add(str)
 	}
 	return str, nil
 }
 
+func (d *Decoder) readBytes(length int) ([]byte, error) {
+	return readFull(d.reader, length)
+}
+
+// maxPrealloc bounds the bytes or elements allocated before they are read,
+// so that lengths read from the wire cannot exhaust memory. Longer values
+// grow as they arrive.
+const maxPrealloc = 1 << 12
+
+func preallocLen(length int) int {
+	if length > maxPrealloc {
+		return maxPrealloc
+	}
+	return length
+}
+
+// readFull reads length bytes from r.
+func readFull(r io.Reader, length int) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, preallocLen(length)))
+	if _, err := io.CopyN(buf, r, int64(length)); err != nil {
+		return nil, fmt.Errorf("Cannot read %d byte from reader", length)
+	}
+	return buf.Bytes(), nil
+}
+
 func (d *Decoder) ReadValue(vptr interface{}) error {
 	marker, err := d.ReadUInt8()
 	if err != nil {
@@ -110,14 +160,16 @@ func (d *Decoder) ReadValue(vptr interface{}) error {
 	}
 	v = v.Elem()
 
+	if isBigNumberType(reflectRemoveTypePtrs(v.Type())) {
+		switch Marker(marker) {
+		case MarkerInteger, MarkerDouble, MarkerString:
+			return d.readBigNumber(v, Marker(marker))
+		}
+	}
+
 	switch Marker(marker) {
 	case MarkerUndefined:
-		switch v.Kind() {
-		case reflect.Interface, reflect.Ptr:
-			return setReflectValue(v, &AMF3Undefined{})
-		default:
-			return fmt.Errorf("Read Undefined: Incompatible type")
-		}
+		return setReflectUndefined(v)
 	case MarkerNull:
 		v.Set(reflect.New(v.Type()).Elem())
 		return nil
@@ -126,23 +178,25 @@ func (d *Decoder) ReadValue(vptr interface{}) error {
 	case MarkerTrue:
 		return setReflectValue(v, true)
 	case MarkerInteger:
-		i, err := d.ReadUInt29()
+		i, err := d.ReadInt29()
 		if err != nil {
 			return err
 		}
-		// TODO sign extension
-		return setReflectValue(v, i)
+		return setReflectInt(v, int64(i))
 	case MarkerDouble:
 		var f float64
 		if err := binary.Read(d.reader, binary.BigEndian, &f); err != nil {
 			return err
 		}
-		return setReflectValue(v, f)
+		return setReflectFloat(v, f)
 	case MarkerString:
 		str, err := d.ReadString()
 		if err != nil {
 			return err
 		}
+		if d.NumericStrings {
+			return setReflectNumericString(v, str)
+		}
 		return setReflectValue(v, str)
 	case MarkerDate:
 		ref, err := d.ReadUInt29()
@@ -160,23 +214,301 @@ func (d *Decoder) ReadValue(vptr interface{}) error {
 			if err := binary.Read(d.reader, binary.BigEndian, &f); err != nil {
 				return err
 			}
-			msecs := int64(f)
-			nsecs := 1e6*(msecs%1000) + int64(1e6*(f-float64(msecs)))
-			t := time.Unix(msecs/1000, nsecs)
+			t := millisToTime(f)
 			d.objectRefs.Add(t)
 			return setReflectValue(v, t)
 		}
-	case MarkerXMLDoc:
-		// TODO
-	case MarkerXML:
-		// TODO
+	case MarkerXMLDoc, MarkerXML:
+		return d.readXML(v, Marker(marker))
+	case MarkerVectorInt, MarkerVectorUInt, MarkerVectorDouble:
+		return d.readVector(v, Marker(marker))
+	case MarkerVectorObject:
+		return d.readObjectVector(v)
+	case MarkerDictionary:
+		return d.readDictionary(v)
 	case MarkerByteArray:
-		// TODO
+		ref, err := d.ReadUInt29()
+		if err != nil {
+			return err
+		}
+		if ref&1 == 0 {
+			if val, err := d.objectRefs.Get(int(ref >> 1)); err != nil {
+				return err
+			} else {
+				return setReflectValue(v, val)
+			}
+		}
+		buf, err := d.readBytes(int(ref >> 1))
+		if err != nil {
+			return err
+		}
+		d.objectRefs.Add(buf)
+		return setReflectValue(v, buf)
 	}
 
 	return fmt.Errorf("Unhandled marker: %d", marker)
 }
 
+// readBigNumber reads an integer, double or string into a math/big number.
+func (d *Decoder) readBigNumber(v reflect.Value, marker Marker) error {
+	var val interface{}
+	switch marker {
+	case MarkerInteger:
+		i, err := d.ReadInt29()
+		if err != nil {
+			return err
+		}
+		val = i
+	case MarkerDouble:
+		var f float64
+		if err := binary.Read(d.reader, binary.BigEndian, &f); err != nil {
+			return err
+		}
+		val = f
+	case MarkerString:
+		str, err := d.ReadString()
+		if err != nil {
+			return err
+		}
+		val = str
+	}
+	return setReflectBigNumber(v, val)
+}
+
+func (d *Decoder) readXML(v reflect.Value, marker Marker) error {
+	ref, err := d.ReadUInt29()
+	if err != nil {
+		return err
+	}
+
+	var val interface{}
+	if ref&1 == 0 {
+		if val, err = d.objectRefs.Get(int(ref >> 1)); err != nil {
+			return err
+		}
+	} else {
+		buf, err := d.readBytes(int(ref >> 1))
+		if err != nil {
+			return err
+		}
+		if marker == MarkerXML {
+			val = XML(buf)
+		} else {
+			val = XMLDocument(buf)
+		}
+		d.objectRefs.Add(val)
+	}
+	return setXMLValue(v, val)
+}
+
+// setXMLValue sets an XML or XMLDocument to v. Structs are unmarshaled with
+// encoding/xml.
+func setXMLValue(v reflect.Value, val interface{}) error {
+	if reflectRemoveTypePtrs(v.Type()).Kind() == reflect.Struct {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		return xml.Unmarshal([]byte(reflect.ValueOf(val).String()), v.Addr().Interface())
+	}
+	return setReflectValue(v, val)
+}
+
+func (d *Decoder) readVector(v reflect.Value, marker Marker) error {
+	ref, err := d.ReadUInt29()
+	if err != nil {
+		return err
+	}
+
+	var vec interface{}
+	if ref&1 == 0 {
+		if vec, err = d.objectRefs.Get(int(ref >> 1)); err != nil {
+			return err
+		}
+	} else {
+		length := int(ref >> 1)
+		fixed, err := d.ReadUInt8()
+		if err != nil {
+			return err
+		}
+
+		size := 4
+		if marker == MarkerVectorDouble {
+			size = 8
+		}
+		// Read the elements before allocating them, a vector cannot be
+		// longer than the data left in the reader
+		buf, err := d.readBytes(length * size)
+		if err != nil {
+			return err
+		}
+
+		var values interface{}
+		switch marker {
+		case MarkerVectorInt:
+			vals := make([]int32, length)
+			values, vec = vals, &VectorInt{Fixed: fixed != 0, Values: vals}
+		case MarkerVectorUInt:
+			vals := make([]uint32, length)
+			values, vec = vals, &VectorUInt{Fixed: fixed != 0, Values: vals}
+		case MarkerVectorDouble:
+			vals := make([]float64, length)
+			values, vec = vals, &VectorDouble{Fixed: fixed != 0, Values: vals}
+		}
+		if err := binary.Read(bytes.NewReader(buf), binary.BigEndian, values); err != nil {
+			return err
+		}
+		d.objectRefs.Add(vec)
+	}
+	return setVectorValue(v, vec)
+}
+
+func (d *Decoder) readObjectVector(v reflect.Value) error {
+	ref, err := d.ReadUInt29()
+	if err != nil {
+		return err
+	}
+	if ref&1 == 0 {
+		if vec, err := d.objectRefs.Get(int(ref >> 1)); err != nil {
+			return err
+		} else {
+			return setVectorValue(v, vec)
+		}
+	}
+	length := int(ref >> 1)
+
+	fixed, err := d.ReadUInt8()
+	if err != nil {
+		return err
+	}
+	cls, err := d.ReadString()
+	if err != nil {
+		return err
+	}
+
+	// Decode into the target slice type, or a slice of the registered class
+	var sliceType reflect.Type
+	if tp := reflectRemoveTypePtrs(v.Type()); tp.Kind() == reflect.Slice {
+		sliceType = tp
+	} else if dt := d.getTraitsMapper().FindByClassName(cls); dt != nil {
+		sliceType = reflect.SliceOf(reflect.PtrTo(dt.Type))
+	} else {
+		sliceType = reflect.TypeOf([]interface{}{})
+	}
+	d.logPrintln("ReadObjectVector class", cls, "into", sliceType)
+
+	// The slice grows as elements arrive, the length is not trusted for
+	// allocation
+	values := reflect.MakeSlice(sliceType, 0, preallocLen(length))
+	vec := &VectorObject{
+		Fixed:     fixed != 0,
+		ClassName: cls,
+		Values:    values.Interface(),
+	}
+	d.objectRefs.Add(vec)
+
+	for i := 0; i < length; i++ {
+		values = reflect.Append(values, reflect.Zero(sliceType.Elem()))
+		vec.Values = values.Interface()
+		if err := d.ReadValue(values.Index(i).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+	return setVectorValue(v, vec)
+}
+
+// setVectorValue sets a decoded vector to v. Slices receive the elements
+// only. Interfaces receive the pointer to the wrapper type, which keeps the
+// fixed-length flag and the class name to write the vector back as is.
+func setVectorValue(v reflect.Value, vec interface{}) error {
+	switch reflectRemoveTypePtrs(v.Type()).Kind() {
+	case reflect.Slice:
+		return setReflectValue(v, reflect.ValueOf(vec).Elem().FieldByName("Values").Interface())
+	case reflect.Interface:
+		return setReflectValue(v, vec)
+	}
+	if v.Kind() == reflect.Ptr {
+		return setReflectValue(v, vec)
+	}
+	return setReflectValue(v, reflect.ValueOf(vec).Elem().Interface())
+}
+
+func (d *Decoder) readDictionary(v reflect.Value) error {
+	ref, err := d.ReadUInt29()
+	if err != nil {
+		return err
+	}
+	if ref&1 == 0 {
+		if val, err := d.objectRefs.Get(int(ref >> 1)); err != nil {
+			return err
+		} else {
+			return setReflectValue(v, val)
+		}
+	}
+	length := int(ref >> 1)
+
+	weakKeys, err := d.ReadUInt8()
+	if err != nil {
+		return err
+	}
+
+	// Read into a Go map
+	if tp := reflectRemoveTypePtrs(v.Type()); tp.Kind() == reflect.Map {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(tp))
+		}
+		d.objectRefs.Add(v.Interface())
+
+		for i := 0; i < length; i++ {
+			key := reflect.New(tp.Key())
+			if err := d.ReadValue(key.Interface()); err != nil {
+				return err
+			}
+			val := reflect.New(tp.Elem())
+			if err := d.ReadValue(val.Interface()); err != nil {
+				return err
+			}
+			if k := key.Elem(); k.Kind() == reflect.Interface && !k.IsNil() && !k.Elem().Type().Comparable() {
+				return fmt.Errorf("Dictionary key of type %s is not comparable", k.Elem().Type())
+			}
+			v.SetMapIndex(key.Elem(), val.Elem())
+		}
+		return nil
+	}
+
+	dict := &Dictionary{
+		WeakKeys: weakKeys&1 == 1,
+		Entries:  make([]DictionaryEntry, 0, preallocLen(length)),
+	}
+	d.objectRefs.Add(dict)
+
+	for i := 0; i < length; i++ {
+		var entry DictionaryEntry
+		if err := d.ReadValue(&entry.Key); err != nil {
+			return err
+		}
+		if err := d.ReadValue(&entry.Value); err != nil {
+			return err
+		}
+		dict.Entries = append(dict.Entries, entry)
+	}
+
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		return setReflectValue(v, dict)
+	default:
+		return setReflectValue(v, *dict)
+	}
+}
+
 func (d *Decoder) ReadArray(vptr interface{}) error {
 	v := reflect.ValueOf(vptr)
 	if v.Kind() != reflect.Ptr {
@@ -200,89 +532,210 @@ func (d *Decoder) ReadArray(vptr interface{}) error {
 	}
 	length >>= 1
 
-	if v.IsNil() {
-		if err := createReflectObject(v, reflect.TypeOf(TypedObject{})); err != nil {
-			return err
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
 		}
+		v = v.Elem()
 	}
 
-	d.objectRefs.Add(v.Interface())
-
-	tobj, isTypedObject := v.Interface().(*TypedObject)
-	assocCappable, arrayCappable := false, false
-	switch v.Kind() {
-	case reflect.Map:
-		assocCappable = true
-	case reflect.Slice:
-		arrayCappable = true
+	switch tobj := v.Addr().Interface().(type) {
+	case *TypedObject:
+		return d.readArrayToTypedObject(tobj, int(length))
+	case *ECMAArray:
+		d.objectRefs.Add(tobj)
+		return d.readArrayToECMAArray(tobj, int(length))
 	}
-	d.logPrintln("ReadArray to", v.Type(), "isTypedObject", isTypedObject, "assocCappable", assocCappable, "arrayCappable", arrayCappable)
 
-readMemberLoop:
-	for {
-		key, err := d.ReadString()
-		switch {
-		case err != nil:
-			return err
-		case len(key) == 0:
-			break readMemberLoop
-		}
-
-		if isTypedObject {
-			var val interface{}
-			if err := d.ReadValue(&val); err != nil {
-				return err
-			}
-			tobj.Assoc[key] = val
-		} else {
-			var val interface{}
-			if err := createReflectObject(reflect.ValueOf(&val).Elem(), v.Type().Elem()); err != nil {
+	d.logPrintln("ReadArray to", v.Type())
+	switch v.Kind() {
+	case reflect.Interface:
+		// Dense arrays are read into []interface{}, mixed arrays into ECMAArray
+		arr := &ECMAArray{}
+		slot := d.objectRefs.Reserve()
+		d.objectRefs.Set(slot, arr)
+		if err := d.readArrayAssoc(func(key string) error {
+			entry := ECMAArrayEntry{Key: key}
+			if err := d.ReadValue(&entry.Value); err != nil {
 				return err
 			}
-			vrefl := reflect.ValueOf(val)
-			if vrefl.Kind() != reflect.Ptr {
-				vrefl = vrefl.Addr()
+			arr.Assoc = append(arr.Assoc, entry)
+			return nil
+		}); err != nil {
+			return err
+		}
+		if len(arr.Assoc) > 0 {
+			v.Set(reflect.ValueOf(arr))
+			return d.readArrayDense(arr, int(length))
+		}
+		// Elements are allocated in chunks as they arrive, references hold a
+		// pointer to see the slice as it grows
+		dense := make([]interface{}, preallocLen(int(length)))
+		d.objectRefs.Set(slot, &dense)
+		v.Set(reflect.ValueOf(dense))
+		for i := 0; i < int(length); i++ {
+			if i == len(dense) {
+				dense = append(dense, make([]interface{}, preallocLen(int(length)-i))...)
+				v.Set(reflect.ValueOf(dense))
 			}
-			if err := d.ReadValue(vrefl.Interface()); err != nil {
+			if err := d.ReadValue(&dense[i]); err != nil {
 				return err
 			}
-			if assocCappable {
-				v.SetMapIndex(reflect.ValueOf(key), reflectResolveType(v.Type().Elem().Kind(), reflect.ValueOf(val)))
-			} else {
+		}
+		return nil
+
+	case reflect.Map:
+		// Dense elements are keyed by their index, maps without string keys
+		// ignore the elements
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		d.objectRefs.Add(v.Interface())
+		stringKeys := isMemberKeyType(v.Type().Key())
+		if err := d.readArrayAssoc(func(key string) error {
+			if !stringKeys {
 				d.logPrintln("Ignore key", key)
+				return d.skipValue()
 			}
+			_, err := readObjectField(d, v, key)
+			return err
+		}); err != nil {
+			return err
 		}
-	}
-	for i := 0; i < int(length); i++ {
-		if isTypedObject {
-			var val interface{}
-			if err := d.ReadValue(&val); err != nil {
+		for i := 0; i < int(length); i++ {
+			if !stringKeys {
+				if err := d.skipValue(); err != nil {
+					return err
+				}
+				d.logPrintln("Ignore index", i)
+			} else if _, err := readObjectField(d, v, strconv.Itoa(i)); err != nil {
 				return err
 			}
-			tobj.Array = append(tobj.Array, val)
-		} else {
-			var val interface{}
-			if err := createReflectObject(reflect.ValueOf(&val).Elem(), v.Type().Elem()); err != nil {
-				return err
+		}
+		return nil
+
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), preallocLen(int(length)), preallocLen(int(length))))
+		// Keep a pointer so that references see the elements read later
+		d.objectRefs.Add(v.Addr().Interface())
+		if err := d.readArrayAssoc(func(key string) error {
+			d.logPrintln("Ignore key", key)
+			return d.skipValue()
+		}); err != nil {
+			return err
+		}
+		for i := 0; i < int(length); i++ {
+			if i == v.Len() {
+				n := preallocLen(int(length) - i)
+				v.Set(reflect.AppendSlice(v, reflect.MakeSlice(v.Type(), n, n)))
 			}
-			vrefl := reflect.ValueOf(val)
-			d.logPrintln("vrefl", vrefl.Interface(), "Type", vrefl.Type())
-			if vrefl.Kind() != reflect.Ptr {
-				vrefl = vrefl.Addr()
+			if err := d.ReadValue(v.Index(i).Addr().Interface()); err != nil {
+				return err
 			}
-			if err := d.ReadValue(vrefl.Interface()); err != nil {
+		}
+		return nil
+
+	case reflect.Struct:
+		// Associative part is read into fields
+		v.Set(reflect.Zero(v.Type()))
+		d.objectRefs.Add(v.Addr().Interface())
+		if err := d.readArrayAssoc(func(key string) error {
+			if ignored, err := readObjectField(d, v, key); err != nil {
 				return err
+			} else if ignored {
+				d.logPrintln("Ignore key", key)
 			}
-			if arrayCappable {
-				v.Set(reflect.Append(v, reflectResolveType(v.Type().Elem().Kind(), reflect.ValueOf(val))))
-			} else {
-				d.logPrintln("Ignore index", i)
+			return nil
+		}); err != nil {
+			return err
+		}
+		for i := 0; i < int(length); i++ {
+			if err := d.skipValue(); err != nil {
+				return err
 			}
+			d.logPrintln("Ignore index", i)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Cannot read array into %s", v.Type())
+}
+
+// readArrayAssoc calls readValue for each key of the associative part.
+func (d *Decoder) readArrayAssoc(readValue func(key string) error) error {
+	for {
+		key, err := d.ReadString()
+		switch {
+		case err != nil:
+			return err
+		case len(key) == 0:
+			return nil
+		}
+		if err := readValue(key); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *Decoder) readArrayDense(arr *ECMAArray, length int) error {
+	arr.Dense = make([]interface{}, preallocLen(length))
+	for i := 0; i < length; i++ {
+		if i == len(arr.Dense) {
+			arr.Dense = append(arr.Dense, make([]interface{}, preallocLen(length-i))...)
+		}
+		if err := d.ReadValue(&arr.Dense[i]); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+func (d *Decoder) readArrayToECMAArray(arr *ECMAArray, length int) error {
+	arr.Assoc = nil
+	if err := d.readArrayAssoc(func(key string) error {
+		entry := ECMAArrayEntry{Key: key}
+		if err := d.ReadValue(&entry.Value); err != nil {
+			return err
+		}
+		arr.Assoc = append(arr.Assoc, entry)
+		return nil
+	}); err != nil {
+		return err
+	}
+	return d.readArrayDense(arr, length)
+}
+
+func (d *Decoder) readArrayToTypedObject(tobj *TypedObject, length int) error {
+	if tobj.Assoc == nil {
+		tobj.Assoc = make(map[string]interface{})
+	}
+	d.objectRefs.Add(tobj)
+	if err := d.readArrayAssoc(func(key string) error {
+		var val interface{}
+		if err := d.ReadValue(&val); err != nil {
+			return err
+		}
+		tobj.Assoc[key] = val
+		return nil
+	}); err != nil {
+		return err
+	}
+	for i := 0; i < length; i++ {
+		var val interface{}
+		if err := d.ReadValue(&val); err != nil {
+			return err
+		}
+		tobj.Array = append(tobj.Array, val)
+	}
+	return nil
+}
+
+// skipValue reads a value and drops it. References to it remain valid.
+func (d *Decoder) skipValue() error {
+	var dummy interface{}
+	return d.ReadValue(&dummy)
+}
+
 func (d *Decoder) ReadObject(vptr interface{}) error {
 	v := reflect.ValueOf(vptr)
 	if v.Kind() != reflect.Ptr {
@@ -340,44 +793,33 @@ func (d *Decoder) ReadObject(vptr interface{}) error {
 		d.traitsRefs.Add(traits)
 	}
 
-	switch v.Kind() {
-	case reflect.Interface, reflect.Ptr:
-		if v.IsNil() {
-			if err := setReflectValue(v, d.createObject(traits.ClassName)); err != nil {
-				return err
-			}
-			if v.Kind() == reflect.Interface {
-				v = v.Elem()
-			}
-			if v.Kind() == reflect.Ptr {
-				v = v.Elem()
-			}
-			d.logPrintln("Initialized value for object", traits.ClassName, "Type", v.Type())
-		}
-	default:
-		v.Set(reflect.New(v.Type()).Elem())
-		d.logPrintln("Set zero value for object", traits.ClassName, "Type", v.Type())
+	d.logPrintln("Object Traits", traits)
+	// Proxies of another value take their own reference index
+	switch traits.ClassName {
+	case "flex.messaging.io.ArrayCollection":
+		return d.readProxyObject(v)
 	}
-	if v.Kind() == reflect.Ptr {
-		panic("Must be resolved")
+
+	if v, err = prepareObject(d, v, traits.ClassName); err != nil {
+		return err
 	}
 
-	d.objectRefs.Add(v.Interface())
+	// Add the object before reading the members, so that members referring
+	// back to it get the object being populated
+	d.objectRefs.Add(v.Addr().Interface())
 
-	d.logPrintln("Object Traits", traits)
 	// Handle external object
 	if traits.External {
-		refobj := d.objectRefs.Reserve()
-		if err := d.readExternalObject(traits, vptr); err != nil {
-			return err
-		}
-		*refobj = v
-		return nil
+		return d.readExternalObject(traits, v)
 	}
 
-	switch tobj := v.Interface().(type) {
-	case TypedObject:
+	switch tobj := v.Addr().Interface().(type) {
+	case *TypedObject:
 		d.logPrintln("ReadObject: reading into TypedObject")
+		tobj.Traits = traits
+		if tobj.Assoc == nil {
+			tobj.Assoc = make(map[string]interface{})
+		}
 		for _, key := range traits.Members {
 			var val interface{}
 			if err := d.ReadValue(&val); err != nil {
@@ -402,13 +844,17 @@ func (d *Decoder) ReadObject(vptr interface{}) error {
 					}
 					d.logPrintln("Read dynamic key", key, "value", val)
 					tobj.Assoc[key] = val
+					tobj.DynamicKeys = append(tobj.DynamicKeys, key)
 				}
 			}
 		}
 		d.logPrintln("Read TypedObject:", tobj)
 	default:
+		if err := checkMembersTarget(v.Type()); err != nil {
+			return err
+		}
 		for _, key := range traits.Members {
-			if _, err := d.readObjectField(v, key); err != nil {
+			if _, err := readObjectField(d, v, key); err != nil {
 				return err
 			}
 		}
@@ -422,7 +868,7 @@ func (d *Decoder) ReadObject(vptr interface{}) error {
 				case len(key) == 0:
 					break readDyanmicLoop
 				default:
-					if ignored, err := d.readObjectField(v, key); err != nil {
+					if ignored, err := readObjectField(d, v, key); err != nil {
 						return err
 					} else if ignored {
 						d.logPrintln("ignore key", key, "in class", traits.ClassName)
@@ -435,7 +881,62 @@ func (d *Decoder) ReadObject(vptr interface{}) error {
 	return nil
 }
 
-func (d *Decoder) readObjectField(v reflect.Value, key string) (ignored bool, err error) {
+// prepareObject resolves v to the addressable value an object of className
+// is read into. Nil pointers and interfaces are set to a new object.
+func prepareObject(d valueReader, v reflect.Value, className string) (reflect.Value, error) {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() || v.Elem().Kind() != reflect.Ptr || v.Elem().IsNil() {
+			v.Set(reflect.ValueOf(d.createObject(className)))
+			d.logPrintln("Initialized value for object", className, "Type", v.Elem().Type())
+		}
+		v = v.Elem()
+	case reflect.Map:
+		if err := checkObjectTarget(v); err != nil {
+			return v, err
+		}
+		v.Set(reflect.MakeMap(v.Type()))
+		return v, nil
+	case reflect.Ptr:
+	default:
+		if err := checkObjectTarget(v); err != nil {
+			return v, err
+		}
+		v.Set(reflect.New(v.Type()).Elem())
+		d.logPrintln("Set zero value for object", className, "Type", v.Type())
+		return v, nil
+	}
+
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			obj := reflect.ValueOf(d.createObject(className))
+			if obj.Type().AssignableTo(v.Type()) {
+				v.Set(obj)
+			} else {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			d.logPrintln("Initialized value for object", className, "Type", v.Type())
+		}
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Interface {
+		return prepareObject(d, v, className)
+	}
+	return v, checkObjectTarget(v)
+}
+
+// checkObjectTarget returns an error unless v reads external objects itself
+// or has fields or map elements for members.
+func checkObjectTarget(v reflect.Value) error {
+	if _, ok := v.Addr().Interface().(ExternalizeReadable); ok {
+		return nil
+	}
+	return checkMembersTarget(v.Type())
+}
+
+// readObjectField reads the member key of an object into the field or map
+// element of v. Members without a field are read and ignored.
+func readObjectField(d valueReader, v reflect.Value, key string) (ignored bool, err error) {
 	if !v.CanSet() {
 		panic("readObjectField: v must be settable")
 	}
@@ -447,12 +948,7 @@ func (d *Decoder) readObjectField(v reflect.Value, key string) (ignored bool, er
 		if v.IsNil() {
 			v.Set(reflect.MakeMap(v.Type()))
 		}
-		elemType := v.Type().Elem()
-		if elemType.Kind() == reflect.Ptr {
-			field = reflect.New(elemType.Elem())
-		} else {
-			field = reflect.New(elemType)
-		}
+		field = reflect.New(v.Type().Elem())
 
 	default:
 		field = findFieldByName(v, key)
@@ -469,47 +965,59 @@ func (d *Decoder) readObjectField(v reflect.Value, key string) (ignored bool, er
 			panic("field not settable")
 		}
 		d.logPrintln("Original field type", field.Type())
-		if field.Kind() == reflect.Ptr {
-			if field.IsNil() {
-				if err = createReflectObject(field, field.Type().Elem()); err != nil {
-					return
-				}
-			}
-		} else {
-			field = field.Addr()
-		}
+		// Pointer fields are passed as is, so that references can be shared
+		field = field.Addr()
 	}
 
 	err = d.ReadValue(field.Interface())
 	d.logPrintln("Read field key", key, "type", field.Type(), "value", field.Elem().Interface())
 
 	if v.Kind() == reflect.Map {
-		if v.Type().Elem().Kind() != reflect.Ptr {
-			field = field.Elem()
-		}
-		v.SetMapIndex(reflect.ValueOf(key), field)
+		v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), field.Elem())
 	}
 
 	return
 }
 
-func (d *Decoder) readExternalObject(traits *Traits, vptr interface{}) error {
-	switch traits.ClassName {
-	case "flex.messaging.io.ArrayCollection":
-		return d.ReadValue(vptr)
+// readProxyObject reads an external object wrapping another value into v.
+// Both the proxy and the wrapped value take a reference index.
+func (d *Decoder) readProxyObject(v reflect.Value) error {
+	// References to the proxy met while reading get the wrapped value, which
+	// takes the next index
+	slot := d.objectRefs.Reserve()
+	d.objectRefs.Set(slot, refAlias(slot+1))
+	if err := d.ReadValue(v.Addr().Interface()); err != nil {
+		return err
 	}
-	obj := d.createObject(traits.ClassName)
-	if extobj, ok := obj.(ExternalizeReadable); ok {
+	if v.Kind() == reflect.Interface {
+		d.objectRefs.Set(slot, v.Interface())
+	} else {
+		d.objectRefs.Set(slot, v.Addr().Interface())
+	}
+	return nil
+}
+
+func (d *Decoder) readExternalObject(traits *Traits, v reflect.Value) error {
+	if extobj, ok := v.Addr().Interface().(ExternalizeReadable); ok {
 		return extobj.ReadExternal(d)
 	}
 	return fmt.Errorf("External object not implemented: class=%s", traits.ClassName)
 }
 
-func (d *Decoder) createObject(className string) interface{} {
-	mapper := DefaultTraitsMapper
+func (d *Decoder) getTraitsMapper() *TraitsMapper {
 	if d.TraitsMapper != nil {
-		mapper = d.TraitsMapper
+		return d.TraitsMapper
 	}
+	return DefaultTraitsMapper
+}
+
+func (d *Decoder) createObject(className string) interface{} {
+	return newMappedObject(d.getTraitsMapper(), className)
+}
+
+// newMappedObject returns a pointer to a new value of the type registered for
+// className, or a new TypedObject if there is none.
+func newMappedObject(mapper *TraitsMapper, className string) interface{} {
 	if dt := mapper.FindByClassName(className); dt != nil {
 		return reflect.New(dt.Type).Interface()
 	}
@@ -0,0 +1,166 @@
+package amf
+
+import (
+	"bytes"
+	"testing"
+)
+
+type testOrder struct {
+	ID    int              `amf3:"id"`
+	Lines []*testOrderLine `amf3:"lines"`
+}
+
+type testOrderLine struct {
+	Order *testOrder `amf3:"order"`
+	Qty   int        `amf3:"qty"`
+}
+
+// An order whose lines, sent in an ArrayCollection, point back to the order.
+// Object references: 0 order, 1 collection, 2 array, 3 and 4 lines.
+var testOrderData = []byte{
+	0x0a, 0x23, // object, inline traits, 2 sealed members
+	0x23, 'c', 'o', 'm', '.', 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'O', 'r', 'd', 'e', 'r',
+	0x05, 'i', 'd',
+	0x0b, 'l', 'i', 'n', 'e', 's',
+	0x04, 0x07, // id
+	0x0a, 0x07, // lines, external traits
+	0x43, 'f', 'l', 'e', 'x', '.', 'm', 'e', 's', 's', 'a', 'g', 'i', 'n', 'g', '.',
+	'i', 'o', '.', 'A', 'r', 'r', 'a', 'y', 'C', 'o', 'l', 'l', 'e', 'c', 't', 'i', 'o', 'n',
+	0x09, 0x05, 0x01, // array of 2
+	0x0a, 0x23, // line, inline traits
+	0x2b, 'c', 'o', 'm', '.', 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'O', 'r', 'd', 'e', 'r', 'L', 'i', 'n', 'e',
+	0x0b, 'o', 'r', 'd', 'e', 'r',
+	0x07, 'q', 't', 'y',
+	0x0a, 0x00, // order, reference 0
+	0x04, 0x01, // qty
+	0x0a, 0x09, // line, traits reference 2
+	0x0a, 0x00, // order, reference 0
+	0x04, 0x02, // qty
+}
+
+func TestDecodeBackPointers(t *testing.T) {
+	var order testOrder
+	if err := NewDecoder(bytes.NewReader(testOrderData)).ReadValue(&order); err != nil {
+		t.Fatal(err)
+	}
+	if order.ID != 7 || len(order.Lines) != 2 {
+		t.Fatalf("Decoded %+v", order)
+	}
+	for i, line := range order.Lines {
+		if line.Order != &order {
+			t.Errorf("Line %d points to %p, expect the order %p", i, line.Order, &order)
+		}
+		if line.Qty != i+1 {
+			t.Errorf("Line %d has qty %d", i, line.Qty)
+		}
+	}
+}
+
+func TestDecodeArrayCollectionRefs(t *testing.T) {
+	// Object references: 0 outer array, 1 collection, 2 wrapped array,
+	// 3 object
+	data := []byte{
+		0x09, 0x09, 0x01, // array of 4
+		0x0a, 0x07, // external traits
+		0x43, 'f', 'l', 'e', 'x', '.', 'm', 'e', 's', 's', 'a', 'g', 'i', 'n', 'g', '.',
+		'i', 'o', '.', 'A', 'r', 'r', 'a', 'y', 'C', 'o', 'l', 'l', 'e', 'c', 't', 'i', 'o', 'n',
+		0x09, 0x03, 0x01, // array of 1
+		0x0a, 0x0b, 0x01, // dynamic anonymous object
+		0x03, 'a', 0x04, 0x01, 0x01,
+		0x0a, 0x02, // reference 1, the collection
+		0x09, 0x04, // reference 2, the wrapped array
+		0x0a, 0x06, // reference 3, the object
+	}
+	var out []interface{}
+	if err := NewDecoder(bytes.NewReader(data)).ReadValue(&out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 4 {
+		t.Fatalf("Decoded %d elements", len(out))
+	}
+	obj := out[3]
+	if _, ok := obj.(*TypedObject); !ok {
+		t.Fatalf("Reference 3 is %#v, expect the object", obj)
+	}
+	for i := 0; i < 3; i++ {
+		arr, ok := out[i].([]interface{})
+		if !ok || len(arr) != 1 || arr[0] != obj {
+			t.Errorf("Element %d is %#v, expect the wrapped array", i, out[i])
+		}
+	}
+}
+
+func TestDecodeRefToValueBeingPopulated(t *testing.T) {
+	// An array whose second element is the array itself
+	data := []byte{
+		0x09, 0x05, 0x01, // array of 2
+		0x06, 0x03, 'x',
+		0x09, 0x00, // reference 0
+	}
+	var out interface{}
+	if err := NewDecoder(bytes.NewReader(data)).ReadValue(&out); err != nil {
+		t.Fatal(err)
+	}
+	arr, ok := out.([]interface{})
+	if !ok || len(arr) != 2 {
+		t.Fatalf("Decoded %#v", out)
+	}
+	self, ok := arr[1].([]interface{})
+	if !ok || len(self) != 2 || self[0] != "x" {
+		t.Fatalf("Reference decoded as %#v", arr[1])
+	}
+	// The reference shares the elements read after it
+	if inner, ok := self[1].([]interface{}); !ok || len(inner) != 2 {
+		t.Errorf("Reference does not see its own element: %#v", self[1])
+	}
+}
+
+func TestDecodeLengthsBeyondData(t *testing.T) {
+	for _, data := range [][]byte{
+		{0x0c, 0xff, 0xff, 0xff, 0xff, 0x00},       // byte array
+		{0x09, 0xff, 0xff, 0xff, 0xff, 0x01},       // array
+		{0x0d, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}, // Vector.<int>
+		{0x10, 0xff, 0xff, 0xff, 0xff, 0x00, 0x01}, // Vector.<Object>
+		{0x11, 0xff, 0xff, 0xff, 0xff, 0x00},       // dictionary
+	} {
+		var out interface{}
+		if err := NewDecoder(bytes.NewReader(data)).ReadValue(&out); err == nil {
+			t.Errorf("Decoded % x without error", data)
+		}
+	}
+}
+
+func TestDecodeMembersInvalidTarget(t *testing.T) {
+	object := []byte{0x0a, 0x0b, 0x01, 0x03, 'a', 0x04, 0x01, 0x01}
+	for _, vptr := range []interface{}{new(int), new(map[int]int), new([]int)} {
+		if err := NewDecoder(bytes.NewReader(object)).ReadValue(vptr); err == nil {
+			t.Errorf("Decoded object into %T without error", vptr)
+		}
+	}
+
+	// An array with a key and an element into a map without string keys
+	array := []byte{0x09, 0x03, 0x03, 'a', 0x04, 0x01, 0x01, 0x04, 0x02}
+	var m map[int]int
+	if err := NewDecoder(bytes.NewReader(array)).ReadValue(&m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 0 {
+		t.Errorf("Decoded %#v, expect no elements", m)
+	}
+}
+
+func TestDecodeUndefined(t *testing.T) {
+	var v interface{}
+	if err := NewDecoder(bytes.NewReader([]byte{0x00})).ReadValue(&v); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := v.(*AMF3Undefined); !ok {
+		t.Errorf("Decoded %#v, expect *AMF3Undefined", v)
+	}
+	testRoundTrip(t, []byte{0x00})
+
+	var n *int
+	if err := NewDecoder(bytes.NewReader([]byte{0x00})).ReadValue(&n); err != nil || n != nil {
+		t.Errorf("Decoded %v, %v, expect nil", n, err)
+	}
+}
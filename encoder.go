@@ -6,25 +6,74 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"sort"
+	"strconv"
+	"time"
 )
 
 type ExternalizeWritable interface {
 	WriteExternal(e *Encoder) error
 }
 
+// IntegerPolicy selects how integers that cannot be represented exactly by
+// a double are written.
+type IntegerPolicy int
+
+const (
+	// Fail with a RangeError
+	IntegerError IntegerPolicy = iota
+	// Write the nearest double
+	IntegerLossy
+	// Write a decimal string
+	IntegerString
+)
+
+// largeIntegerValue returns the value to write for an integer beyond the
+// range of the encoding, the double f or as decided by policy the decimal
+// string str if f is not exact.
+func largeIntegerValue(policy IntegerPolicy, f float64, exact bool, str string, logPrintln func(...interface{})) (interface{}, error) {
+	if !exact {
+		switch policy {
+		case IntegerLossy:
+			logPrintln("Integer", str, "loses precision as double")
+		case IntegerString:
+			return str, nil
+		default:
+			return nil, &RangeError{str, reflect.TypeOf(f)}
+		}
+	}
+	return f, nil
+}
+
 type Encoder struct {
 	VerboseLog bool
 
 	TraitsMapper *TraitsMapper
 
+	// Write slices of registered types as Vector.<T> instead of arrays. A
+	// single struct field can be written as vector with the amf3_vector tag.
+	ObjectVectors bool
+
+	// Write string-keyed maps as associative arrays instead of anonymous
+	// dynamic objects.
+	MapsAsArrays bool
+
+	// Write nil slices as empty arrays instead of null.
+	NilSlicesAsEmptyArrays bool
+
+	// How to write integers beyond the precision of a double.
+	LargeIntegers IntegerPolicy
+
 	writer io.Writer
 
 	stringRefs refTable
-	objectRefs refTable
+	objectRefs objectRefIndex
 	traitsRefs refTable
 
 	stringRefMap  map[string]int
-	traitsRefsMap map[string]int
+	traitsRefsMap map[*Traits]int
+
+	anonymousTraits map[reflect.Type]*Traits
 }
 
 func NewEncoder(writer io.Writer) *Encoder {
@@ -32,7 +81,9 @@ func NewEncoder(writer io.Writer) *Encoder {
 		writer: writer,
 
 		stringRefMap:  make(map[string]int),
-		traitsRefsMap: make(map[string]int),
+		traitsRefsMap: make(map[*Traits]int),
+
+		anonymousTraits: make(map[reflect.Type]*Traits),
 	}
 }
 
@@ -104,10 +155,86 @@ func (e *Encoder) WriteValue(vif interface{}) error {
 	for v.IsValid() && (v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr) {
 		v = v.Elem()
 	}
-	if !v.IsValid() {
+	if !v.IsValid() || e.isNilSlice(v) {
 		return e.writeMarker(MarkerNull)
 	}
 
+	if isBigNumberType(v.Type()) {
+		return e.WriteValue(bigNumberValue(v, false))
+	}
+
+	if v.CanInterface() {
+		switch x := v.Interface().(type) {
+		case AMF3Undefined:
+			return e.writeMarker(MarkerUndefined)
+		case AMF3Null:
+			return e.writeMarker(MarkerNull)
+		case XML:
+			if err := e.writeMarker(MarkerXML); err != nil {
+				return err
+			}
+			return e.WriteXML(string(x))
+		case XMLDocument:
+			if err := e.writeMarker(MarkerXMLDoc); err != nil {
+				return err
+			}
+			return e.WriteXML(string(x))
+		case VectorInt:
+			if err := e.writeMarker(MarkerVectorInt); err != nil {
+				return err
+			}
+			return e.writeVector(MarkerVectorInt, x.Fixed, x.Values)
+		case []int32:
+			if err := e.writeMarker(MarkerVectorInt); err != nil {
+				return err
+			}
+			return e.writeVector(MarkerVectorInt, false, x)
+		case VectorUInt:
+			if err := e.writeMarker(MarkerVectorUInt); err != nil {
+				return err
+			}
+			return e.writeVector(MarkerVectorUInt, x.Fixed, x.Values)
+		case []uint32:
+			if err := e.writeMarker(MarkerVectorUInt); err != nil {
+				return err
+			}
+			return e.writeVector(MarkerVectorUInt, false, x)
+		case VectorDouble:
+			if err := e.writeMarker(MarkerVectorDouble); err != nil {
+				return err
+			}
+			return e.writeVector(MarkerVectorDouble, x.Fixed, x.Values)
+		case []float64:
+			if err := e.writeMarker(MarkerVectorDouble); err != nil {
+				return err
+			}
+			return e.writeVector(MarkerVectorDouble, false, x)
+		case VectorObject:
+			if err := e.writeMarker(MarkerVectorObject); err != nil {
+				return err
+			}
+			return e.writeObjectVector(x.Fixed, x.ClassName, reflect.ValueOf(x.Values))
+		case ECMAArray:
+			if err := e.writeMarker(MarkerArray); err != nil {
+				return err
+			}
+			return e.writeECMAArray(v, x)
+		case Dictionary:
+			if err := e.writeMarker(MarkerDictionary); err != nil {
+				return err
+			}
+			return e.WriteDictionary(x)
+		case time.Time:
+			if err := e.writeMarker(MarkerDate); err != nil {
+				return err
+			}
+			if ok, err := e.writeObjectRef(MarkerDate, v); ok || err != nil {
+				return err
+			}
+			return e.writeDate(x)
+		}
+	}
+
 	const maxUInt29 int64 = 0x3FFFFFFF
 	const maxInt29 int64 = 0x1FFFFFFF
 	const minInt29 int64 = -0x1FFFFFFF - 1
@@ -123,7 +250,8 @@ func (e *Encoder) WriteValue(vif interface{}) error {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		i := v.Int()
 		if i < minInt29 || i > maxInt29 {
-			return e.WriteValue(float64(i))
+			f, exact := intToDouble(i)
+			return e.writeLargeInteger(f, exact, strconv.FormatInt(i, 10))
 		}
 		if err := e.writeMarker(MarkerInteger); err != nil {
 			return err
@@ -133,7 +261,8 @@ func (e *Encoder) WriteValue(vif interface{}) error {
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		i := v.Uint()
 		if i > uint64(maxInt29) {
-			return e.WriteValue(float64(i))
+			f, exact := uintToDouble(i)
+			return e.writeLargeInteger(f, exact, strconv.FormatUint(i, 10))
 		}
 		if err := e.writeMarker(MarkerInteger); err != nil {
 			return err
@@ -152,14 +281,50 @@ func (e *Encoder) WriteValue(vif interface{}) error {
 		}
 		return e.WriteString(v.String())
 
-	case reflect.Slice:
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if err := e.writeMarker(MarkerByteArray); err != nil {
+				return err
+			}
+			if v.Kind() == reflect.Array {
+				b := make([]byte, v.Len())
+				for i := range b {
+					b[i] = byte(v.Index(i).Uint())
+				}
+				return e.WriteByteArray(b)
+			}
+			return e.WriteByteArray(v.Bytes())
+		}
+		if e.ObjectVectors && v.Kind() == reflect.Slice {
+			if cls, ok := e.getVectorClassName(v.Type().Elem()); ok {
+				if err := e.writeMarker(MarkerVectorObject); err != nil {
+					return err
+				}
+				return e.writeObjectVector(false, cls, v)
+			}
+		}
 		if err := e.writeMarker(MarkerArray); err != nil {
 			return err
 		}
 		return e.WriteArray(vif)
 
 	case reflect.Map:
-		panic("TODO") // TODO
+		if v.Type().Key().Kind() != reflect.String {
+			if err := e.writeMarker(MarkerDictionary); err != nil {
+				return err
+			}
+			return e.writeMapDictionary(v)
+		}
+		if e.MapsAsArrays {
+			if err := e.writeMarker(MarkerArray); err != nil {
+				return err
+			}
+			return e.writeMapArray(v)
+		}
+		if err := e.writeMarker(MarkerObject); err != nil {
+			return err
+		}
+		return e.writeMapObject(v)
 
 	case reflect.Struct:
 		if err := e.writeMarker(MarkerObject); err != nil {
@@ -173,20 +338,59 @@ func (e *Encoder) WriteValue(vif interface{}) error {
 	panic("Not reached")
 }
 
+// writeLargeInteger writes an integer out of the U29 range as a double, or
+// as decided by LargeIntegers if the double f is not exact.
+func (e *Encoder) writeLargeInteger(f float64, exact bool, str string) error {
+	val, err := largeIntegerValue(e.LargeIntegers, f, exact, str, e.logPrintln)
+	if err != nil {
+		return err
+	}
+	return e.WriteValue(val)
+}
+
+// maxObjectRef is the largest index of a U29 reference.
+const maxObjectRef = 0xFFFFFFF
+
+// writeObjectRef writes a reference and returns true if the object of v has
+// been written before with the same marker. Otherwise v is added to the
+// object reference table.
+func (e *Encoder) writeObjectRef(marker Marker, v reflect.Value) (bool, error) {
+	if ref, ok := e.objectRefs.findOrAdd(uint8(marker), v, maxObjectRef); ok {
+		e.logPrintln("Write object using ref", ref)
+		return true, e.WriteUInt29(uint32(ref << 1))
+	}
+	return false, nil
+}
+
+// WriteDate writes t as a new date. Dates written by WriteValue through the
+// same pointer are written as references.
+func (e *Encoder) WriteDate(t time.Time) error {
+	e.objectRefs.Add(t)
+	return e.writeDate(t)
+}
+
+func (e *Encoder) writeDate(t time.Time) error {
+	if err := e.WriteUInt29(0x1); err != nil {
+		return err
+	}
+	return binary.Write(e.writer, binary.BigEndian, timeToMillis(t))
+}
+
 func (e *Encoder) WriteArray(vif interface{}) error {
 	v := reflect.ValueOf(vif)
 	for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
 		v = v.Elem()
 	}
-	if v.Kind() != reflect.Slice {
-		panic("Must be a slice")
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		panic("Must be a slice or an array")
 	}
 
-	e.objectRefs.Add(v.Interface())
-	sl := v.Interface().([]interface{})
+	if ok, err := e.writeObjectRef(MarkerArray, v); ok || err != nil {
+		return err
+	}
 
 	// Length and ref
-	if err := e.WriteUInt29(uint32(len(sl)<<1) | 0x1); err != nil {
+	if err := e.WriteUInt29(uint32(v.Len()<<1) | 0x1); err != nil {
 		return err
 	}
 
@@ -196,7 +400,8 @@ func (e *Encoder) WriteArray(vif interface{}) error {
 	}
 
 	// Dense part
-	for _, el := range sl {
+	for i := 0; i < v.Len(); i++ {
+		el := v.Index(i).Interface()
 		e.logPrintln("ARRAY write element", el)
 		if err := e.WriteValue(el); err != nil {
 			return err
@@ -206,6 +411,280 @@ func (e *Encoder) WriteArray(vif interface{}) error {
 	return nil
 }
 
+func (e *Encoder) isNilSlice(v reflect.Value) bool {
+	return v.Kind() == reflect.Slice && v.IsNil() && !e.NilSlicesAsEmptyArrays
+}
+
+// writeECMAArray writes both parts of arr, using the identity of v for
+// references.
+func (e *Encoder) writeECMAArray(v reflect.Value, arr ECMAArray) error {
+	if ok, err := e.writeObjectRef(MarkerArray, v); ok || err != nil {
+		return err
+	}
+
+	// Length and ref
+	if err := e.WriteUInt29(uint32(len(arr.Dense)<<1) | 0x1); err != nil {
+		return err
+	}
+
+	// Associative part
+	for _, entry := range arr.Assoc {
+		if entry.Key == "" {
+			return errors.New("Empty string cannot be used as key")
+		}
+		if err := e.WriteString(entry.Key); err != nil {
+			return err
+		}
+		if err := e.WriteValue(entry.Value); err != nil {
+			return err
+		}
+	}
+	if err := e.WriteString(""); err != nil {
+		return err
+	}
+
+	// Dense part
+	for _, el := range arr.Dense {
+		if err := e.WriteValue(el); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Encoder) writeMapArray(v reflect.Value) error {
+	if ok, err := e.writeObjectRef(MarkerArray, v); ok || err != nil {
+		return err
+	}
+
+	// No dense part
+	if err := e.WriteUInt29(0x1); err != nil {
+		return err
+	}
+
+	if err := e.writeMapMembers(v); err != nil {
+		return err
+	}
+
+	// End of associative part
+	return e.WriteString("")
+}
+
+func (e *Encoder) writeMapObject(v reflect.Value) error {
+	if ok, err := e.writeObjectRef(MarkerObject, v); ok || err != nil {
+		return err
+	}
+
+	// Anonymous dynamic object without sealed members
+	if err := e.writeTraits(&Traits{Dynamic: true}); err != nil {
+		return err
+	}
+
+	if err := e.writeMapMembers(v); err != nil {
+		return err
+	}
+
+	// End of dynamic fields
+	return e.WriteString("")
+}
+
+func (e *Encoder) writeMapMembers(v reflect.Value) error {
+	for _, key := range sortedMapKeys(v) {
+		if key.String() == "" {
+			return errors.New("Empty string cannot be used as key")
+		}
+		if err := e.WriteString(key.String()); err != nil {
+			return err
+		}
+		if err := e.WriteValue(v.MapIndex(key).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Encoder) WriteByteArray(b []byte) error {
+	if ok, err := e.writeObjectRef(MarkerByteArray, reflect.ValueOf(b)); ok || err != nil {
+		return err
+	}
+
+	// Length and ref
+	if err := e.WriteUInt29(uint32(len(b)<<1) | 0x1); err != nil {
+		return err
+	}
+
+	_, err := e.writer.Write(b)
+	return err
+}
+
+// WriteXML writes the body of an XML or XMLDocument value. XML strings are
+// not put into the string reference table.
+func (e *Encoder) WriteXML(str string) error {
+	e.objectRefs.Add(str)
+
+	// Length and ref
+	if err := e.WriteUInt29(uint32(len(str)<<1) | 0x1); err != nil {
+		return err
+	}
+
+	_, err := e.writer.Write([]byte(str))
+	return err
+}
+
+// writeVector writes the body of a Vector.<int>, Vector.<uint> or
+// Vector.<Number>, values must be one of []int32, []uint32 or []float64.
+func (e *Encoder) writeVector(marker Marker, fixed bool, values interface{}) error {
+	if ok, err := e.writeObjectRef(marker, reflect.ValueOf(values)); ok || err != nil {
+		return err
+	}
+
+	// Length and ref
+	if err := e.WriteUInt29(uint32(reflect.ValueOf(values).Len()<<1) | 0x1); err != nil {
+		return err
+	}
+
+	var fixedByte uint8
+	if fixed {
+		fixedByte = 1
+	}
+	if err := e.WriteUInt8(fixedByte); err != nil {
+		return err
+	}
+
+	return binary.Write(e.writer, binary.BigEndian, values)
+}
+
+// writeObjectVector writes the body of a Vector.<T>, values must be a slice.
+func (e *Encoder) writeObjectVector(fixed bool, className string, values reflect.Value) error {
+	for values.Kind() == reflect.Interface || values.Kind() == reflect.Ptr {
+		values = values.Elem()
+	}
+	if values.Kind() != reflect.Slice {
+		return fmt.Errorf("Vector values must be a slice, got %v", values.Kind())
+	}
+
+	if ok, err := e.writeObjectRef(MarkerVectorObject, values); ok || err != nil {
+		return err
+	}
+
+	// Length and ref
+	if err := e.WriteUInt29(uint32(values.Len()<<1) | 0x1); err != nil {
+		return err
+	}
+
+	var fixedByte uint8
+	if fixed {
+		fixedByte = 1
+	}
+	if err := e.WriteUInt8(fixedByte); err != nil {
+		return err
+	}
+
+	if className == "" {
+		className = "*"
+	}
+	if err := e.WriteString(className); err != nil {
+		return err
+	}
+
+	for i := 0; i < values.Len(); i++ {
+		if err := e.WriteValue(values.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Encoder) getVectorClassName(elemType reflect.Type) (string, bool) {
+	dt := e.getTraitsMapper().FindByReflectType(reflectRemoveTypePtrs(elemType))
+	if dt == nil || dt.Traits.ClassName == "" {
+		return "", false
+	}
+	return dt.Traits.ClassName, true
+}
+
+// fieldValue returns the value to write for a struct field of value fif.
+// Nil fields tagged amf3_undefined are written as undefined, and math/big
+// numbers tagged amf3_big:"double" as doubles.
+func fieldValue(fif interface{}, tag reflect.StructTag) interface{} {
+	if tag.Get("amf3_undefined") != "" {
+		if v := reflect.ValueOf(fif); !v.IsValid() || (v.Kind() == reflect.Ptr && v.IsNil()) {
+			return Undefined
+		}
+	}
+	if tag.Get("amf3_big") == "double" {
+		v := reflect.ValueOf(fif)
+		for v.Kind() == reflect.Ptr && !v.IsNil() {
+			v = v.Elem()
+		}
+		if v.IsValid() && isBigNumberType(v.Type()) {
+			return bigNumberValue(v, true)
+		}
+	}
+	return fif
+}
+
+// writeFieldValue writes the value of a struct field, honoring the options
+// in the field tag.
+func (e *Encoder) writeFieldValue(fif interface{}, tag reflect.StructTag) error {
+	if tag.Get("amf3_vector") != "" {
+		v := reflect.ValueOf(fif)
+		if v.Kind() == reflect.Slice && !e.isNilSlice(v) {
+			cls, _ := e.getVectorClassName(v.Type().Elem())
+			if err := e.writeMarker(MarkerVectorObject); err != nil {
+				return err
+			}
+			return e.writeObjectVector(false, cls, v)
+		}
+	}
+	return e.WriteValue(fieldValue(fif, tag))
+}
+
+func (e *Encoder) WriteDictionary(dict Dictionary) error {
+	return e.writeDictionary(reflect.ValueOf(dict.Entries), dict)
+}
+
+// writeDictionary writes dict, using the identity of v for references.
+func (e *Encoder) writeDictionary(v reflect.Value, dict Dictionary) error {
+	if ok, err := e.writeObjectRef(MarkerDictionary, v); ok || err != nil {
+		return err
+	}
+
+	// Length and ref
+	if err := e.WriteUInt29(uint32(len(dict.Entries)<<1) | 0x1); err != nil {
+		return err
+	}
+
+	var weakKeys uint8
+	if dict.WeakKeys {
+		weakKeys = 1
+	}
+	if err := e.WriteUInt8(weakKeys); err != nil {
+		return err
+	}
+
+	for _, entry := range dict.Entries {
+		if err := e.WriteValue(entry.Key); err != nil {
+			return err
+		}
+		if err := e.WriteValue(entry.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Encoder) writeMapDictionary(v reflect.Value) error {
+	dict := Dictionary{Entries: make([]DictionaryEntry, 0, v.Len())}
+	for _, key := range sortedMapKeys(v) {
+		dict.Entries = append(dict.Entries, DictionaryEntry{
+			Key:   key.Interface(),
+			Value: v.MapIndex(key).Interface(),
+		})
+	}
+	return e.writeDictionary(v, dict)
+}
+
 func (e *Encoder) WriteObject(vif interface{}) error {
 	v := reflect.ValueOf(vif)
 	for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
@@ -215,11 +694,20 @@ func (e *Encoder) WriteObject(vif interface{}) error {
 		panic("Must be a struct")
 	}
 
-	traits, ref := e.getReflectTraits(v)
-	if traits == nil {
-		// TODO
-		e.logPrintln("No traits for type", v.Type())
-		panic("TODO")
+	if ok, err := e.writeObjectRef(MarkerObject, v); ok || err != nil {
+		return err
+	}
+
+	var traits *Traits
+	var ref int
+	if tobj, ok := v.Interface().(TypedObject); ok {
+		traits = tobj.Traits
+		if traits == nil {
+			traits = &Traits{Dynamic: true}
+		}
+		ref = e.findTraitsRef(traits)
+	} else {
+		traits, ref = e.getReflectTraits(v)
 	}
 	if ref >= 0 {
 		if err := e.WriteUInt29(uint32(ref<<2) | 0x1); err != nil {
@@ -231,12 +719,6 @@ func (e *Encoder) WriteObject(vif interface{}) error {
 		}
 	}
 
-	if v.CanAddr() {
-		e.objectRefs.Add(v.Addr().Interface())
-	} else {
-		e.objectRefs.Add(v.Interface())
-	}
-
 	// Handle external object
 	if traits.External {
 		if encobj, ok := v.Addr().Interface().(ExternalizeWritable); ok {
@@ -246,21 +728,38 @@ func (e *Encoder) WriteObject(vif interface{}) error {
 		}
 	}
 
-	switch v.Interface().(type) {
+	switch tobj := v.Interface().(type) {
 	case TypedObject:
-		// TODO
-		panic("TODO")
+		for _, key := range traits.Members {
+			if err := e.WriteValue(tobj.Assoc[key]); err != nil {
+				return err
+			}
+		}
+		if traits.Dynamic {
+			for _, key := range typedObjectDynamicKeys(tobj, traits) {
+				if err := e.WriteString(key); err != nil {
+					return err
+				}
+				if err := e.WriteValue(tobj.Assoc[key]); err != nil {
+					return err
+				}
+			}
+			// End of dynamic fields
+			if err := e.WriteString(""); err != nil {
+				return err
+			}
+		}
 
 	default:
 		for _, key := range traits.Members {
-			field := findFieldByName(v, key)
+			field, sf := findStructFieldByName(v, key)
 
 			var fif interface{} = nil
 			if field.IsValid() {
 				fif = field.Interface()
 			}
 
-			if err := e.WriteValue(fif); err != nil {
+			if err := e.writeFieldValue(fif, sf.Tag); err != nil {
 				return err
 			}
 		}
@@ -287,7 +786,7 @@ func (e *Encoder) WriteObject(vif interface{}) error {
 					if err := e.WriteString(sf.Name); err != nil {
 						return err
 					}
-					if err := e.WriteValue(field.Interface()); err != nil {
+					if err := e.writeFieldValue(field.Interface(), sf.Tag); err != nil {
 						return err
 					}
 				}
@@ -302,11 +801,34 @@ func (e *Encoder) WriteObject(vif interface{}) error {
 	return nil
 }
 
-func (e *Encoder) writeTraits(traits *Traits) error {
-	if len(traits.ClassName) > 0 {
-		e.traitsRefsMap[traits.ClassName] = e.traitsRefs.Len()
-		e.traitsRefs.Add(traits)
+// typedObjectDynamicKeys returns the keys of tobj that are not sealed
+// members of traits: dynamic members in the order they were read, then the
+// others sorted.
+func typedObjectDynamicKeys(tobj TypedObject, traits *Traits) []string {
+	written := make(map[string]bool)
+	for _, key := range traits.Members {
+		written[key] = true
+	}
+	keys := make([]string, 0, len(tobj.Assoc))
+	for _, key := range tobj.DynamicKeys {
+		if _, ok := tobj.Assoc[key]; ok && !written[key] {
+			keys = append(keys, key)
+			written[key] = true
+		}
 	}
+	remaining := make([]string, 0, len(tobj.Assoc))
+	for key := range tobj.Assoc {
+		if !written[key] {
+			remaining = append(remaining, key)
+		}
+	}
+	sort.Strings(remaining)
+	return append(keys, remaining...)
+}
+
+func (e *Encoder) writeTraits(traits *Traits) error {
+	e.traitsRefsMap[traits] = e.traitsRefs.Len()
+	e.traitsRefs.Add(traits)
 
 	ref := uint32(3)
 
@@ -316,7 +838,7 @@ func (e *Encoder) writeTraits(traits *Traits) error {
 		if traits.Dynamic {
 			ref |= 0x8
 		}
-		ref |= uint32(traits.Nmemb) << 4
+		ref |= uint32(len(traits.Members)) << 4
 	}
 
 	if err := e.WriteUInt29(ref); err != nil {
@@ -327,8 +849,8 @@ func (e *Encoder) writeTraits(traits *Traits) error {
 	}
 
 	if !traits.External {
-		for i := 0; i < traits.Nmemb; i++ {
-			if err := e.WriteString(traits.Members[i]); err != nil {
+		for _, key := range traits.Members {
+			if err := e.WriteString(key); err != nil {
 				return err
 			}
 		}
@@ -337,20 +859,46 @@ func (e *Encoder) writeTraits(traits *Traits) error {
 	return nil
 }
 
-func (e *Encoder) getReflectTraits(v reflect.Value) (traits *Traits, ref int) {
-	mapper := DefaultTraitsMapper
+func (e *Encoder) getTraitsMapper() *TraitsMapper {
 	if e.TraitsMapper != nil {
-		mapper = e.TraitsMapper
+		return e.TraitsMapper
 	}
-	dt := mapper.FindByReflectType(v.Type())
+	return DefaultTraitsMapper
+}
+
+func (e *Encoder) getReflectTraits(v reflect.Value) (traits *Traits, ref int) {
+	dt := e.getTraitsMapper().FindByReflectType(v.Type())
 
 	if dt == nil {
-		return nil, -1
-	} else if ref, ok := e.traitsRefsMap[dt.Traits.ClassName]; ok {
-		return dt.Traits, ref
+		traits := e.getAnonymousTraits(v)
+		return traits, e.findTraitsRef(traits)
 	} else {
-		return dt.Traits, -1
+		return dt.Traits, e.findTraitsRef(dt.Traits)
+	}
+}
+
+// getAnonymousTraits returns the traits of an anonymous object for structs
+// not registered to the TraitsMapper.
+func (e *Encoder) getAnonymousTraits(v reflect.Value) *Traits {
+	if traits, ok := e.anonymousTraits[v.Type()]; ok {
+		return traits
+	}
+	e.logPrintln("No traits for type", v.Type(), "using anonymous traits")
+	members, dynamics := getStructMembersAndDynamics(v)
+	traits := &Traits{
+		Dynamic: len(dynamics) > 0,
+		Nmemb:   len(members),
+		Members: members,
+	}
+	e.anonymousTraits[v.Type()] = traits
+	return traits
+}
+
+func (e *Encoder) findTraitsRef(traits *Traits) int {
+	if ref, ok := e.traitsRefsMap[traits]; ok {
+		return ref
 	}
+	return -1
 }
 
 func (e *Encoder) logPrintln(objs ...interface{}) {
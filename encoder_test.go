@@ -0,0 +1,61 @@
+package amf
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testRoundTrip decodes data into an interface and checks that encoding it
+// again gives the same bytes.
+func testRoundTrip(t *testing.T, data []byte) {
+	var v interface{}
+	if err := NewDecoder(bytes.NewReader(data)).ReadValue(&v); err != nil {
+		t.Fatalf("Cannot decode % x: %v", data, err)
+	}
+	buf := &bytes.Buffer{}
+	if err := NewEncoder(buf).WriteValue(v); err != nil {
+		t.Fatalf("Cannot encode %#v: %v", v, err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Round trip of % x gives % x", data, buf.Bytes())
+	}
+}
+
+func TestRoundTripVectors(t *testing.T) {
+	// Anonymous object with a fixed Vector.<*> and a Vector.<int>
+	testRoundTrip(t, []byte{
+		0x0a, 0x0b, 0x01,
+		0x03, 'v', 0x10, 0x03, 0x00, 0x03, '*', 0x04, 0x01,
+		0x03, 'w', 0x0d, 0x03, 0x01, 0x00, 0x00, 0x00, 0x07,
+		0x01,
+	})
+	// Vector.<uint> and Vector.<Number> in an array
+	testRoundTrip(t, []byte{
+		0x09, 0x05, 0x01,
+		0x0e, 0x03, 0x00, 0xff, 0xff, 0xff, 0xff,
+		0x0f, 0x03, 0x01, 0x3f, 0xf0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	})
+}
+
+func TestEncodeTypedObjectMembers(t *testing.T) {
+	// Nmemb is left unset, the members are written
+	obj := &TypedObject{
+		Traits: &Traits{ClassName: "com.example.Point", Members: []string{"x", "y"}},
+		Assoc:  map[string]interface{}{"x": 1, "y": 2},
+	}
+	buf := &bytes.Buffer{}
+	if err := NewEncoder(buf).WriteValue(obj); err != nil {
+		t.Fatal(err)
+	}
+	var out interface{}
+	if err := NewDecoder(buf).ReadValue(&out); err != nil {
+		t.Fatal(err)
+	}
+	tobj, ok := out.(*TypedObject)
+	if !ok || tobj.Traits.ClassName != "com.example.Point" || tobj.Assoc["x"] != int32(1) || tobj.Assoc["y"] != int32(2) {
+		t.Errorf("Decoded %#v", out)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes left", buf.Len())
+	}
+}
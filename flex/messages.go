@@ -2,9 +2,11 @@ package flex
 
 import (
 	"amf"
+	"errors"
 	"fmt"
 	"math/rand"
 	"reflect"
+	"time"
 )
 
 type Flags struct {
@@ -311,6 +313,22 @@ type AcknowledgeMessage struct {
 	flags Flags
 }
 
+// NewAcknowledgeMessage returns an acknowledgement correlated to the request
+// message req.
+func NewAcknowledgeMessage(req *AbstractMessage) *AcknowledgeMessage {
+	m := &AcknowledgeMessage{}
+	m.ClientId = req.ClientId
+	if m.ClientId == nil {
+		m.ClientId = NewUUID()
+	}
+	m.CorrelationId = req.MessageId
+	m.Destination = req.Destination
+	m.MessageId = NewUUID()
+	m.Timestamp = amf.Int64(time.Now().UnixNano() / int64(time.Millisecond))
+	m.TimeToLive = amf.Int64(0)
+	return m
+}
+
 func (m *AcknowledgeMessage) GetAcknowledgeMessage() *AcknowledgeMessage {
 	return m
 }
@@ -353,6 +371,11 @@ func (m *AcknowledgeMessageExt) WriteExternal(e *amf.Encoder) error {
 	return m.AcknowledgeMessage.WriteExternal(e)
 }
 
+/* flex.messaging.messages.ErrorMessage */
+
+// ErrorMessage is the fault of a request, dispatched as FaultEvent by Flex.
+// Unlike the acknowledgement it extends, it has no small form and is always
+// written with its class traits, so that the fault members are kept.
 type ErrorMessage struct {
 	AcknowledgeMessage
 	FaultCode    *string     `amf3:"faultCode"`
@@ -362,6 +385,40 @@ type ErrorMessage struct {
 	ExtendedData interface{} `amf3:"extendedData"`
 }
 
+// Fault can be implemented by errors to supply the members of ErrorMessage.
+// Empty codes and details, and nil extended data are left unset.
+type Fault interface {
+	error
+	FaultCode() string
+	FaultDetail() string
+	ExtendedData() interface{}
+}
+
+// DefaultFaultCode is the fault code of errors not implementing Fault.
+const DefaultFaultCode = "Server.Processing"
+
+// NewErrorMessage returns the fault of err correlated to the request message
+// req. The fault string is the message of err.
+func NewErrorMessage(req *AbstractMessage, err error) *ErrorMessage {
+	m := &ErrorMessage{
+		AcknowledgeMessage: *NewAcknowledgeMessage(req),
+		FaultCode:          amf.String(DefaultFaultCode),
+		FaultString:        amf.String(err.Error()),
+	}
+
+	var fault Fault
+	if errors.As(err, &fault) {
+		if code := fault.FaultCode(); code != "" {
+			m.FaultCode = amf.String(code)
+		}
+		if detail := fault.FaultDetail(); detail != "" {
+			m.FaultDetail = amf.String(detail)
+		}
+		m.ExtendedData = fault.ExtendedData()
+	}
+	return m
+}
+
 func (m *ErrorMessage) GetErrorMessage() *ErrorMessage {
 	return m
 }
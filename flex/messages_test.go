@@ -0,0 +1,58 @@
+package flex
+
+import (
+	"amf"
+	"bytes"
+	"os"
+	"testing"
+)
+
+// testdata/arraycollection_backrefs.amf is a remoting response laid out as
+// BlazeDS writes it: an AcknowledgeMessageExt of unknown length with client,
+// message and correlation ids as bytes, whose body is an ArrayCollection of
+// two employees. Both point to the same department, whose employees member
+// refers back to the collection.
+func TestReadBlazeDSArrayCollection(t *testing.T) {
+	data, err := os.ReadFile("testdata/arraycollection_backrefs.amf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := amf.ReadPacket(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Messages) != 1 || p.Messages[0].TargetURI != "/1/onResult" {
+		t.Fatalf("Read %+v", p)
+	}
+	ack, ok := p.Messages[0].Value.(*AcknowledgeMessageExt)
+	if !ok {
+		t.Fatalf("Message value %#v, expect an AcknowledgeMessageExt", p.Messages[0].Value)
+	}
+	if ack.Timestamp == nil || *ack.Timestamp != 1476700000123 {
+		t.Errorf("Timestamp %v", ack.Timestamp)
+	}
+
+	employees, ok := ack.Body.([]interface{})
+	if !ok || len(employees) != 2 {
+		t.Fatalf("Body %#v, expect 2 employees", ack.Body)
+	}
+	var dept *amf.TypedObject
+	for i, name := range []string{"Ann", "Bob"} {
+		emp, ok := employees[i].(*amf.TypedObject)
+		if !ok || emp.Traits.ClassName != "com.example.Employee" || emp.Assoc["name"] != name {
+			t.Fatalf("Employee %d is %#v", i, employees[i])
+		}
+		d, ok := emp.Assoc["department"].(*amf.TypedObject)
+		if !ok || (dept != nil && d != dept) {
+			t.Fatalf("Employee %d has department %#v, expect %p", i, emp.Assoc["department"], dept)
+		}
+		dept = d
+	}
+	if dept.Assoc["name"] != "Sales" {
+		t.Errorf("Department %#v", dept)
+	}
+	back, ok := dept.Assoc["employees"].([]interface{})
+	if !ok || len(back) != 2 || back[0] != employees[0] || back[1] != employees[1] {
+		t.Errorf("Department employees %#v, expect the collection", dept.Assoc["employees"])
+	}
+}
@@ -0,0 +1,305 @@
+package gateway
+
+import (
+	"amf"
+	"amf/flex"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const ContentType = "application/x-amf"
+
+// DefaultMaxRequestSize is the size limit of request bodies of handlers not
+// setting MaxRequestSize.
+const DefaultMaxRequestSize = 10 << 20
+
+// Call is a remoting call decoded from a message of a request packet.
+type Call struct {
+	Service string
+	Method  string
+	Args    []interface{}
+
+	// Message is the RemotingMessage of AMF3 calls, nil for AMF0 calls.
+	Message *flex.RemotingMessage
+
+	Request *http.Request
+}
+
+type Dispatcher interface {
+	Dispatch(call *Call) (interface{}, error)
+}
+
+type DispatcherFunc func(call *Call) (interface{}, error)
+
+func (f DispatcherFunc) Dispatch(call *Call) (interface{}, error) {
+	return f(call)
+}
+
+// Handler serves Flash Remoting requests. Each message of the request packet
+// is dispatched by its target URI, "Service.method" for AMF0 calls, or by the
+// destination and operation of a RemotingMessage for AMF3 calls. Results and
+// errors are written to a single response packet.
+type Handler struct {
+	// Calls are dispatched to the DefaultRegistry if nil.
+	Dispatcher Dispatcher
+
+	// Larger request bodies are refused. DefaultMaxRequestSize is used if 0.
+	MaxRequestSize int64
+
+	// Create the decoder of requests and the encoder of responses, to set
+	// their options. Header and message values are read and written with
+	// the options of these. The TraitsMapper of a Registry dispatcher is
+	// used if they have none.
+	NewDecoder func(r io.Reader) *amf.AMF0Decoder
+	NewEncoder func(w io.Writer) *amf.AMF0Encoder
+}
+
+func NewHandler(dispatcher Dispatcher) *Handler {
+	return &Handler{
+		Dispatcher: dispatcher,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != ContentType {
+		http.Error(w, "Content type must be "+ContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// The body is read in memory first, so that lengths in the packet are
+	// checked against the bytes actually sent
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.getMaxRequestSize()))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	req, err := h.newDecoder(bytes.NewReader(body)).ReadPacket()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	enc := h.newEncoder(buf)
+	resp := &amf.Packet{Version: req.Version}
+	for _, msg := range req.Messages {
+		m, err := encodeMessage(enc, req.Version, msg, h.handleMessage(r, msg))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.Messages = append(resp.Messages, m)
+	}
+
+	if err := enc.WritePacket(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Write(buf.Bytes())
+}
+
+func (h *Handler) newDecoder(r io.Reader) *amf.AMF0Decoder {
+	var d *amf.AMF0Decoder
+	if h.NewDecoder != nil {
+		d = h.NewDecoder(r)
+	} else {
+		d = amf.NewAMF0Decoder(r)
+	}
+	if d.TraitsMapper == nil {
+		d.TraitsMapper = h.getTraitsMapper()
+	}
+	return d
+}
+
+func (h *Handler) newEncoder(w io.Writer) *amf.AMF0Encoder {
+	var e *amf.AMF0Encoder
+	if h.NewEncoder != nil {
+		e = h.NewEncoder(w)
+	} else {
+		e = amf.NewAMF0Encoder(w)
+	}
+	if e.TraitsMapper == nil {
+		e.TraitsMapper = h.getTraitsMapper()
+	}
+	return e
+}
+
+// getTraitsMapper returns the TraitsMapper of a Registry dispatcher, nil
+// for the DefaultTraitsMapper.
+func (h *Handler) getTraitsMapper() *amf.TraitsMapper {
+	if reg, ok := h.getDispatcher().(*Registry); ok {
+		return reg.TraitsMapper
+	}
+	return nil
+}
+
+func (h *Handler) getMaxRequestSize() int64 {
+	if h.MaxRequestSize > 0 {
+		return h.MaxRequestSize
+	}
+	return DefaultMaxRequestSize
+}
+
+func (h *Handler) getDispatcher() Dispatcher {
+	if h.Dispatcher != nil {
+		return h.Dispatcher
+	}
+	return DefaultRegistry
+}
+
+// handleMessage returns the response message of msg.
+func (h *Handler) handleMessage(r *http.Request, msg amf.Message) amf.Message {
+	args := messageArgs(msg.Value)
+
+	// AMF3 calls are sent in a single flex message
+	if len(args) == 1 {
+		switch m := args[0].(type) {
+		case interface {
+			GetRemotingMessage() *flex.RemotingMessage
+		}:
+			return h.handleRemotingMessage(r, msg, m.GetRemotingMessage())
+		case interface {
+			GetCommandMessage() *flex.CommandMessage
+		}:
+			ack := flex.NewAcknowledgeMessage(&m.GetCommandMessage().AbstractMessage)
+			return resultMessage(msg, ack)
+		}
+	}
+
+	i := strings.LastIndex(msg.TargetURI, ".")
+	if i < 0 {
+		return statusMessage(msg, fmt.Errorf("Invalid target %s", msg.TargetURI))
+	}
+	result, err := h.getDispatcher().Dispatch(&Call{
+		Service: msg.TargetURI[:i],
+		Method:  msg.TargetURI[i+1:],
+		Args:    args,
+		Request: r,
+	})
+	if err != nil {
+		return statusMessage(msg, err)
+	}
+	return resultMessage(msg, result)
+}
+
+func (h *Handler) handleRemotingMessage(r *http.Request, msg amf.Message, m *flex.RemotingMessage) amf.Message {
+	call := &Call{
+		Args:    messageArgs(m.Body),
+		Message: m,
+		Request: r,
+	}
+	if m.Destination != nil {
+		call.Service = *m.Destination
+	}
+	if m.Operation != nil {
+		call.Method = *m.Operation
+	}
+
+	result, err := h.getDispatcher().Dispatch(call)
+	if err != nil {
+		return statusMessage(msg, flex.NewErrorMessage(&m.AbstractMessage, err))
+	}
+
+	ack := flex.NewAcknowledgeMessage(&m.AbstractMessage)
+	ack.Body = result
+	return resultMessage(msg, ack)
+}
+
+// encodeMessage encodes the value of the response m of msg. Values failing
+// to encode are replaced by the error, so that other messages of the packet
+// are still sent.
+func encodeMessage(enc *amf.AMF0Encoder, version uint16, msg amf.Message, m amf.Message) (amf.Message, error) {
+	value, err := enc.EncodePacketValue(version, m.Value)
+	if err != nil {
+		if req := abstractMessage(msg); req != nil {
+			m = statusMessage(msg, flex.NewErrorMessage(req, err))
+		} else {
+			m = statusMessage(msg, err)
+		}
+		if value, err = enc.EncodePacketValue(version, m.Value); err != nil {
+			return m, err
+		}
+	}
+	m.Value = value
+	return m, nil
+}
+
+// abstractMessage returns the flex message of AMF3 calls, nil for AMF0 calls.
+func abstractMessage(msg amf.Message) *flex.AbstractMessage {
+	if args := messageArgs(msg.Value); len(args) == 1 {
+		if m, ok := args[0].(interface {
+			GetAbstractMessage() *flex.AbstractMessage
+		}); ok {
+			return m.GetAbstractMessage()
+		}
+	}
+	return nil
+}
+
+// messageArgs returns the arguments sent in the value of a message.
+func messageArgs(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return v
+	}
+	return []interface{}{value}
+}
+
+func resultMessage(msg amf.Message, value interface{}) amf.Message {
+	return amf.Message{
+		TargetURI:   msg.ResponseURI + "/onResult",
+		ResponseURI: "null",
+		Value:       value,
+	}
+}
+
+// status is the NetConnection status object of AMF0 errors.
+type status struct {
+	Level       string `amf3:"level"`
+	Code        string `amf3:"code"`
+	Description string `amf3:"description"`
+	Details     string `amf3:"details"`
+}
+
+// statusMessage returns the /onStatus response of msg, value is either an
+// error or an ErrorMessage.
+func statusMessage(msg amf.Message, value interface{}) amf.Message {
+	if err, ok := value.(error); ok {
+		st := &status{
+			Level:       "error",
+			Code:        flex.DefaultFaultCode,
+			Description: err.Error(),
+		}
+		var fault flex.Fault
+		if errors.As(err, &fault) {
+			if code := fault.FaultCode(); code != "" {
+				st.Code = code
+			}
+			st.Details = fault.FaultDetail()
+		}
+		value = st
+	}
+	return amf.Message{
+		TargetURI:   msg.ResponseURI + "/onStatus",
+		ResponseURI: "null",
+		Value:       value,
+	}
+}
@@ -0,0 +1,303 @@
+package gateway
+
+import (
+	"amf"
+	"amf/flex"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type calc struct{}
+
+func (calc) Add(a, b int) int {
+	return a + b
+}
+
+func (calc) Big() int64 {
+	return 1<<53 + 1
+}
+
+func (calc) Fail() error {
+	return errors.New("failed")
+}
+
+func (calc) Crash() int {
+	panic("secret")
+}
+
+type testPoint struct {
+	X int `amf3:"x"`
+	Y int `amf3:"y"`
+}
+
+type geo struct{}
+
+func (geo) Move(p testPoint, dx int) testPoint {
+	p.X += dx
+	return p
+}
+
+func newTestHandler(t *testing.T) *Handler {
+	reg := NewRegistry()
+	if err := reg.Register("Calc", calc{}); err != nil {
+		t.Fatal(err)
+	}
+	return NewHandler(reg)
+}
+
+// serve posts body to h and returns the response.
+func serve(h http.Handler, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/gateway", bytes.NewReader(body))
+	r.Header.Set("Content-Type", ContentType)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// servePacket posts req to h and reads the response packet.
+func servePacket(t *testing.T, h http.Handler, req *amf.Packet) *amf.Packet {
+	buf := &bytes.Buffer{}
+	if err := amf.WritePacket(buf, req); err != nil {
+		t.Fatal(err)
+	}
+	w := serve(h, buf.Bytes())
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("Content type %q", ct)
+	}
+	resp, err := amf.ReadPacket(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Messages) != len(req.Messages) {
+		t.Fatalf("Got %d messages, expect %d", len(resp.Messages), len(req.Messages))
+	}
+	return resp
+}
+
+func TestServeHTTPAMF0(t *testing.T) {
+	resp := servePacket(t, newTestHandler(t), &amf.Packet{
+		Messages: []amf.Message{
+			{TargetURI: "Calc.add", ResponseURI: "/1", Value: []interface{}{1, 2}},
+			{TargetURI: "Calc.fail", ResponseURI: "/2", Value: []interface{}{}},
+		},
+	})
+	if resp.Version != 0 {
+		t.Errorf("Version %d", resp.Version)
+	}
+
+	if m := resp.Messages[0]; m.TargetURI != "/1/onResult" || m.Value != float64(3) {
+		t.Errorf("Got %s %#v, expect /1/onResult 3", m.TargetURI, m.Value)
+	}
+
+	m := resp.Messages[1]
+	if m.TargetURI != "/2/onStatus" {
+		t.Errorf("Got %s, expect /2/onStatus", m.TargetURI)
+	}
+	var st status
+	buf := &bytes.Buffer{}
+	if err := amf.NewAMF0Encoder(buf).WriteValue(m.Value); err != nil {
+		t.Fatal(err)
+	}
+	if err := amf.NewAMF0Decoder(buf).ReadValue(&st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Level != "error" || st.Code != flex.DefaultFaultCode || st.Description != "failed" {
+		t.Errorf("Status %+v", st)
+	}
+}
+
+func TestServeHTTPAMF3(t *testing.T) {
+	call := &flex.RemotingMessage{Operation: amf.String("add")}
+	call.Destination = amf.String("Calc")
+	call.MessageId = flex.NewUUID()
+	call.Body = []interface{}{1, 2}
+
+	fail := &flex.RemotingMessage{Operation: amf.String("fail")}
+	fail.Destination = amf.String("Calc")
+	fail.MessageId = flex.NewUUID()
+
+	resp := servePacket(t, newTestHandler(t), &amf.Packet{
+		Version: amf.ObjectEncodingAMF3,
+		Messages: []amf.Message{
+			{TargetURI: "null", ResponseURI: "/1", Value: []interface{}{call}},
+			{TargetURI: "null", ResponseURI: "/2", Value: []interface{}{fail}},
+		},
+	})
+	if resp.Version != amf.ObjectEncodingAMF3 {
+		t.Errorf("Version %d", resp.Version)
+	}
+
+	m := resp.Messages[0]
+	ack, ok := m.Value.(interface {
+		GetAcknowledgeMessage() *flex.AcknowledgeMessage
+	})
+	if m.TargetURI != "/1/onResult" || !ok {
+		t.Fatalf("Got %s %#v, expect /1/onResult with an AcknowledgeMessage", m.TargetURI, m.Value)
+	}
+	if a := ack.GetAcknowledgeMessage(); a.Body != int32(3) || a.CorrelationId == nil || *a.CorrelationId != *call.MessageId {
+		t.Errorf("Acknowledge %+v", a)
+	}
+
+	m = resp.Messages[1]
+	errMsg, ok := m.Value.(interface {
+		GetErrorMessage() *flex.ErrorMessage
+	})
+	if m.TargetURI != "/2/onStatus" || !ok {
+		t.Fatalf("Got %s %#v, expect /2/onStatus with an ErrorMessage", m.TargetURI, m.Value)
+	}
+	if e := errMsg.GetErrorMessage(); e.FaultString == nil || *e.FaultString != "failed" {
+		t.Errorf("Error %+v", e)
+	}
+}
+
+func TestServeHTTPEncoderOptions(t *testing.T) {
+	h := newTestHandler(t)
+	h.NewEncoder = func(w io.Writer) *amf.AMF0Encoder {
+		enc := amf.NewAMF0Encoder(w)
+		enc.LargeIntegers = amf.IntegerString
+		return enc
+	}
+	resp := servePacket(t, h, &amf.Packet{
+		Messages: []amf.Message{
+			{TargetURI: "Calc.big", ResponseURI: "/1", Value: []interface{}{}},
+		},
+	})
+	if m := resp.Messages[0]; m.TargetURI != "/1/onResult" || m.Value != "9007199254740993" {
+		t.Errorf("Got %s %#v, expect /1/onResult \"9007199254740993\"", m.TargetURI, m.Value)
+	}
+}
+
+func TestServeHTTPEncodeError(t *testing.T) {
+	// Big cannot be written exactly as a double, only its own message fails
+	resp := servePacket(t, newTestHandler(t), &amf.Packet{
+		Messages: []amf.Message{
+			{TargetURI: "Calc.add", ResponseURI: "/1", Value: []interface{}{1, 2}},
+			{TargetURI: "Calc.big", ResponseURI: "/2", Value: []interface{}{}},
+		},
+	})
+	if m := resp.Messages[0]; m.TargetURI != "/1/onResult" || m.Value != float64(3) {
+		t.Errorf("Got %s %#v, expect /1/onResult 3", m.TargetURI, m.Value)
+	}
+	if m := resp.Messages[1]; m.TargetURI != "/2/onStatus" {
+		t.Errorf("Got %s %#v, expect /2/onStatus", m.TargetURI, m.Value)
+	}
+
+	big := &flex.RemotingMessage{Operation: amf.String("big")}
+	big.Destination = amf.String("Calc")
+	big.MessageId = flex.NewUUID()
+	resp = servePacket(t, newTestHandler(t), &amf.Packet{
+		Version: amf.ObjectEncodingAMF3,
+		Messages: []amf.Message{
+			{TargetURI: "null", ResponseURI: "/1", Value: []interface{}{big}},
+		},
+	})
+	m := resp.Messages[0]
+	if _, ok := m.Value.(interface {
+		GetErrorMessage() *flex.ErrorMessage
+	}); m.TargetURI != "/1/onStatus" || !ok {
+		t.Errorf("Got %s %#v, expect /1/onStatus with an ErrorMessage", m.TargetURI, m.Value)
+	}
+}
+
+func TestServeHTTPRegistryTraitsMapper(t *testing.T) {
+	mapper := amf.NewTraitsMapper()
+	flex.RegisterToTraitsMapper(mapper)
+	mapper.RegisterType(testPoint{}, amf.NewTraits(testPoint{}, "test.Point", false))
+	reg := NewRegistry()
+	reg.TraitsMapper = mapper
+	if err := reg.Register("Geo", geo{}); err != nil {
+		t.Fatal(err)
+	}
+
+	call := &flex.RemotingMessage{Operation: amf.String("move")}
+	call.Destination = amf.String("Geo")
+	call.MessageId = flex.NewUUID()
+	call.Body = []interface{}{testPoint{1, 2}, 3}
+
+	buf := &bytes.Buffer{}
+	enc := amf.NewAMF0Encoder(buf)
+	enc.TraitsMapper = mapper
+	if err := enc.WritePacket(&amf.Packet{
+		Version: amf.ObjectEncodingAMF3,
+		Messages: []amf.Message{
+			{TargetURI: "null", ResponseURI: "/1", Value: []interface{}{call}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	w := serve(NewHandler(reg), buf.Bytes())
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status %d: %s", w.Code, w.Body.String())
+	}
+	dec := amf.NewAMF0Decoder(w.Body)
+	dec.TraitsMapper = mapper
+	resp, err := dec.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := resp.Messages[0]
+	ack, ok := m.Value.(interface {
+		GetAcknowledgeMessage() *flex.AcknowledgeMessage
+	})
+	if m.TargetURI != "/1/onResult" || !ok {
+		t.Fatalf("Got %s %#v, expect /1/onResult with an AcknowledgeMessage", m.TargetURI, m.Value)
+	}
+	body := ack.GetAcknowledgeMessage().Body
+	if p, ok := body.(*testPoint); !ok || *p != (testPoint{4, 2}) {
+		t.Errorf("Result %#v, expect a test.Point", body)
+	}
+}
+
+func TestServeHTTPPanic(t *testing.T) {
+	resp := servePacket(t, newTestHandler(t), &amf.Packet{
+		Messages: []amf.Message{
+			{TargetURI: "Calc.crash", ResponseURI: "/1", Value: []interface{}{}},
+		},
+	})
+	m := resp.Messages[0]
+	if m.TargetURI != "/1/onStatus" {
+		t.Fatalf("Got %s %#v, expect /1/onStatus", m.TargetURI, m.Value)
+	}
+	var st status
+	buf := &bytes.Buffer{}
+	if err := amf.NewAMF0Encoder(buf).WriteValue(m.Value); err != nil {
+		t.Fatal(err)
+	}
+	if err := amf.NewAMF0Decoder(buf).ReadValue(&st); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(st.Description, "secret") {
+		t.Errorf("Fault shows the panic: %q", st.Description)
+	}
+}
+
+func TestServeHTTPMaxRequestSize(t *testing.T) {
+	h := newTestHandler(t)
+	h.MaxRequestSize = 16
+	if w := serve(h, make([]byte, 17)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Status %d, expect %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestServeHTTPInvalidLength(t *testing.T) {
+	// The message claims more bytes than sent, and a strict array of
+	// 0x7ffffff0 elements
+	body := []byte{
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		0x00, 0x01, 'a', 0x00, 0x01, '1',
+		0xff, 0xff, 0xff, 0xf0,
+		0x0a, 0x7f, 0xff, 0xff, 0xf0,
+	}
+	if w := serve(newTestHandler(t), body); w.Code != http.StatusBadRequest {
+		t.Errorf("Status %d, expect %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,190 @@
+package gateway
+
+import (
+	"amf"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Registry is a Dispatcher calling the exported methods of registered
+// services. Method names are matched case-insensitively, so that "getOrder"
+// calls GetOrder.
+//
+// Arguments are converted to the parameter types as the Decoder does, and a
+// context.Context first parameter receives the context of the request. A
+// method returns at most a result and an error, errors are sent as faults.
+type Registry struct {
+	// Classes of arguments and results, also used by a Handler dispatching
+	// to the registry to read requests and write responses. Flex messages
+	// must be registered with flex.RegisterToTraitsMapper for AMF3 calls.
+	TraitsMapper *amf.TraitsMapper
+
+	mu       sync.RWMutex
+	services map[string]*service
+}
+
+type service struct {
+	value   reflect.Value
+	methods map[string]reflect.Method
+}
+
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		services: make(map[string]*service),
+	}
+}
+
+// Register registers svc to the DefaultRegistry.
+func Register(name string, svc interface{}) error {
+	return DefaultRegistry.Register(name, svc)
+}
+
+func (r *Registry) Register(name string, svc interface{}) error {
+	v := reflect.ValueOf(svc)
+	if !v.IsValid() {
+		return fmt.Errorf("Service %s is nil", name)
+	}
+
+	s := &service{
+		value:   v,
+		methods: make(map[string]reflect.Method),
+	}
+	for i := 0; i < v.Type().NumMethod(); i++ {
+		m := v.Type().Method(i)
+		if m.Type.NumOut() > 2 ||
+			(m.Type.NumOut() == 2 && m.Type.Out(1) != errorType) {
+			continue
+		}
+		s.methods[strings.ToLower(m.Name)] = m
+	}
+	if len(s.methods) == 0 {
+		return fmt.Errorf("Service %s has no methods to call", name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.services[name] = s
+	return nil
+}
+
+func (r *Registry) Dispatch(call *Call) (result interface{}, err error) {
+	r.mu.RLock()
+	s, ok := r.services[call.Service]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown service %s", call.Service)
+	}
+	m, ok := s.methods[strings.ToLower(call.Method)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown method %s.%s", call.Service, call.Method)
+	}
+
+	in, err := r.methodArgs(call, m.Type)
+	if err != nil {
+		return nil, fmt.Errorf("%s.%s: %v", call.Service, call.Method, err)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			// The panic is not sent to the client
+			log.Printf("%s.%s: panic: %v\n%s", call.Service, call.Method, p, debug.Stack())
+			result, err = nil, fmt.Errorf("%s.%s: Internal error", call.Service, call.Method)
+		}
+	}()
+	out := m.Func.Call(append([]reflect.Value{s.value}, in...))
+
+	if n := len(out); n > 0 && m.Type.Out(n-1) == errorType {
+		if !out[n-1].IsNil() {
+			return nil, out[n-1].Interface().(error)
+		}
+		out = out[:n-1]
+	}
+	if len(out) > 0 {
+		result = out[0].Interface()
+	}
+	return result, nil
+}
+
+// methodArgs converts the arguments of call to the parameters of a method of
+// type mt, whose first parameter is the receiver.
+func (r *Registry) methodArgs(call *Call, mt reflect.Type) ([]reflect.Value, error) {
+	var in []reflect.Value
+	first := 1
+	if mt.NumIn() > 1 && mt.In(1) == contextType {
+		in = append(in, reflect.ValueOf(callContext(call)))
+		first++
+	}
+
+	nparams := mt.NumIn() - first
+	if mt.IsVariadic() {
+		if len(call.Args) < nparams-1 {
+			return nil, fmt.Errorf("Expect at least %d arguments, got %d", nparams-1, len(call.Args))
+		}
+	} else if len(call.Args) != nparams {
+		return nil, fmt.Errorf("Expect %d arguments, got %d", nparams, len(call.Args))
+	}
+
+	for i, arg := range call.Args {
+		var tp reflect.Type
+		if mt.IsVariadic() && i >= nparams-1 {
+			tp = mt.In(mt.NumIn() - 1).Elem()
+		} else {
+			tp = mt.In(first + i)
+		}
+		v, err := r.convertArg(arg, tp)
+		if err != nil {
+			return nil, fmt.Errorf("Argument %d: %v", i, err)
+		}
+		in = append(in, v)
+	}
+	return in, nil
+}
+
+// convertArg converts arg to type tp by writing it in AMF3 and reading it
+// back with the Decoder.
+func (r *Registry) convertArg(arg interface{}, tp reflect.Type) (reflect.Value, error) {
+	buf := &bytes.Buffer{}
+	enc := amf.NewEncoder(buf)
+	enc.TraitsMapper = r.TraitsMapper
+	if err := enc.WriteValue(arg); err != nil {
+		return reflect.Value{}, err
+	}
+
+	v := reflect.New(tp)
+	dec := amf.NewDecoder(buf)
+	dec.TraitsMapper = r.TraitsMapper
+	if err := dec.ReadValue(v.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+	return v.Elem(), nil
+}
+
+type callContextKey struct{}
+
+// callContext returns the context of the request of call, carrying call.
+func callContext(call *Call) context.Context {
+	ctx := context.Background()
+	if call.Request != nil {
+		ctx = call.Request.Context()
+	}
+	return context.WithValue(ctx, callContextKey{}, call)
+}
+
+// CallFromContext returns the call of the context passed to a method.
+func CallFromContext(ctx context.Context) (*Call, bool) {
+	call, ok := ctx.Value(callContextKey{}).(*Call)
+	return call, ok
+}
@@ -23,19 +23,130 @@ const (
 	MarkerObject
 	MarkerXML
 	MarkerByteArray
+	MarkerVectorInt
+	MarkerVectorUInt
+	MarkerVectorDouble
+	MarkerVectorObject
+	MarkerDictionary
+)
+
+// AMF0 Marker
+type AMF0Marker uint8
+
+const (
+	AMF0MarkerNumber AMF0Marker = iota
+	AMF0MarkerBoolean
+	AMF0MarkerString
+	AMF0MarkerObject
+	AMF0MarkerMovieClip
+	AMF0MarkerNull
+	AMF0MarkerUndefined
+	AMF0MarkerReference
+	AMF0MarkerECMAArray
+	AMF0MarkerObjectEnd
+	AMF0MarkerStrictArray
+	AMF0MarkerDate
+	AMF0MarkerLongString
+	AMF0MarkerUnsupported
+	AMF0MarkerRecordSet
+	AMF0MarkerXMLDoc
+	AMF0MarkerTypedObject
+	AMF0MarkerAVMPlus
 )
 
 // Predefined types
 type AMF3Undefined struct{}
 type AMF3Null struct{}
 
+// Undefined is the undefined value, which the Encoder writes as undefined
+// instead of null, as it does *AMF3Undefined. Interfaces receive a
+// *AMF3Undefined when undefined is decoded.
+var Undefined = AMF3Undefined{}
+
+func (_ AMF3Undefined) MarshalJSON() ([]byte, error) {
+	return json.Marshal(nil)
+}
+
 func (_ AMF3Null) MarshalJSON() ([]byte, error) {
 	return json.Marshal(nil)
 }
 
+// XML is the E4X XML type, encoded with MarkerXML.
+type XML string
+
+// XMLDocument is the legacy flash.xml.XMLDocument type, encoded with
+// MarkerXMLDoc.
+type XMLDocument string
+
+// Vector types keep the fixed-length flag of AMF3 vectors. Plain []int32,
+// []uint32 and []float64 slices are also encoded and decoded as vectors.
+// Vectors decoded into interfaces are pointers to the vector types.
+type VectorInt struct {
+	Fixed  bool
+	Values []int32
+}
+
+type VectorUInt struct {
+	Fixed  bool
+	Values []uint32
+}
+
+type VectorDouble struct {
+	Fixed  bool
+	Values []float64
+}
+
+// VectorObject is a Vector.<T> of objects. ClassName is the element type
+// name, "*" for untyped vectors. Values holds a slice, []*T when ClassName is
+// registered or []interface{} otherwise.
+type VectorObject struct {
+	Fixed     bool
+	ClassName string
+	Values    interface{}
+}
+
+// Dictionary is a flash.utils.Dictionary. Unlike objects its keys can be of
+// any type, entries are kept in the order they were read.
+type Dictionary struct {
+	WeakKeys bool
+	Entries  []DictionaryEntry
+}
+
+type DictionaryEntry struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// ECMAArray is an array with both an associative and a dense part. Keys of
+// the associative part are kept in order. AMF0 ECMA arrays have no dense
+// part, all their keys are read into Assoc.
+type ECMAArray struct {
+	Assoc []ECMAArrayEntry
+	Dense []interface{}
+
+	// Count is the length of an AMF0 ECMA array as read, which producers do
+	// not always set to the number of entries. A nil Count is written as the
+	// number of entries.
+	Count *uint32
+}
+
+type ECMAArrayEntry struct {
+	Key   string
+	Value interface{}
+}
+
+// TypedObject holds objects of classes not registered to the TraitsMapper.
+// Traits and DynamicKeys keep the class name, member order and dynamic
+// members as read, so that the object can be written back unchanged. A nil
+// Traits is written as an anonymous dynamic object.
+//
+// Dates in Assoc and Array are time.Time values, so a date referenced twice in
+// the stream is written back twice inline rather than as a reference.
 type TypedObject struct {
-	Assoc map[string]interface{} `json:"assoc,omitempty"`
-	Array []interface{}          `json:"array,omitempty"`
+	Traits      *Traits                `json:"-"`
+	Assoc       map[string]interface{} `json:"assoc,omitempty"`
+	Array       []interface{}          `json:"array,omitempty"`
+	DynamicKeys []string               `json:"-"`
 }
 
 func (t TypedObject) MarshalJSON() ([]byte, error) {
@@ -68,8 +179,10 @@ type Traits struct {
 	ClassName string
 	External  bool
 	Dynamic   bool
-	Nmemb     int
-	Members   []string
+	// Nmemb is the number of sealed members as read, the encoder writes
+	// len(Members) members.
+	Nmemb   int
+	Members []string
 
 	membersMap map[string]bool
 }
@@ -0,0 +1,234 @@
+package amf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+)
+
+// unknownLength is written as the length of headers and messages by clients
+// that do not compute it.
+const unknownLength = math.MaxUint32
+
+// Packet is the AMF envelope of Flash Remoting requests and responses.
+// Version is ObjectEncodingAMF3 for clients using AMF3, in which case values
+// are written in AMF3 after the avmplus marker.
+type Packet struct {
+	Version  uint16
+	Headers  []Header
+	Messages []Message
+}
+
+type Header struct {
+	Name           string
+	MustUnderstand bool
+	Value          interface{}
+}
+
+// Message is a body of a packet. TargetURI is the method called in requests,
+// or the response URI followed by /onResult or /onStatus in responses.
+type Message struct {
+	TargetURI   string
+	ResponseURI string
+	Value       interface{}
+}
+
+// RawValue is a header or message value already encoded for the version of
+// its packet, written as is by WritePacket.
+type RawValue []byte
+
+// ReadPacket reads a packet with the default options.
+func ReadPacket(r io.Reader) (*Packet, error) {
+	return NewAMF0Decoder(r).ReadPacket()
+}
+
+// ReadPacket reads a packet. Each header and message value is read with its
+// own reference tables, by a decoder with the options of d.
+func (d *AMF0Decoder) ReadPacket() (*Packet, error) {
+	p := &Packet{}
+
+	var err error
+	if p.Version, err = d.ReadUInt16(); err != nil {
+		return nil, err
+	}
+
+	nheaders, err := d.ReadUInt16()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < int(nheaders); i++ {
+		var h Header
+		if h.Name, err = d.ReadString(); err != nil {
+			return nil, err
+		}
+		mustUnderstand, err := d.ReadUInt8()
+		if err != nil {
+			return nil, err
+		}
+		h.MustUnderstand = mustUnderstand != 0
+		if err := d.readPacketValue(&h.Value); err != nil {
+			return nil, fmt.Errorf("Cannot read header %s: %v", h.Name, err)
+		}
+		p.Headers = append(p.Headers, h)
+	}
+
+	nmessages, err := d.ReadUInt16()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < int(nmessages); i++ {
+		var m Message
+		if m.TargetURI, err = d.ReadString(); err != nil {
+			return nil, err
+		}
+		if m.ResponseURI, err = d.ReadString(); err != nil {
+			return nil, err
+		}
+		if err := d.readPacketValue(&m.Value); err != nil {
+			return nil, fmt.Errorf("Cannot read message %s: %v", m.TargetURI, err)
+		}
+		p.Messages = append(p.Messages, m)
+	}
+
+	return p, nil
+}
+
+// readPacketValue reads the length and the value of a header or message.
+func (d *AMF0Decoder) readPacketValue(vptr interface{}) error {
+	length, err := d.ReadUInt32()
+	if err != nil {
+		return err
+	}
+	if length == unknownLength {
+		return d.valueDecoder(d.GetReader()).ReadValue(vptr)
+	}
+	// Readers knowing the bytes left, such as request bodies read in memory,
+	// refuse lengths beyond them before anything is read
+	if r, ok := d.GetReader().(interface{ Len() int }); ok && int64(length) > int64(r.Len()) {
+		return fmt.Errorf("Length %d exceeds the %d byte left", length, r.Len())
+	}
+
+	// The value is read through a limited reader rather than buffered, and
+	// the bytes it does not use are skipped
+	lr := &io.LimitedReader{R: d.GetReader(), N: int64(length)}
+	if err := d.valueDecoder(lr).ReadValue(vptr); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, lr); err != nil {
+		return err
+	}
+	if lr.N > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// valueDecoder returns a decoder of r with the options of d and empty
+// reference tables.
+func (d *AMF0Decoder) valueDecoder(r io.Reader) *AMF0Decoder {
+	dec := NewAMF0Decoder(r)
+	dec.VerboseLog = d.VerboseLog
+	dec.TraitsMapper = d.TraitsMapper
+	dec.NumericStrings = d.NumericStrings
+	return dec
+}
+
+// WritePacket writes a packet with the default options.
+func WritePacket(w io.Writer, p *Packet) error {
+	return NewAMF0Encoder(w).WritePacket(p)
+}
+
+// WritePacket writes a packet. Values are written by encoders with the
+// options of e, in AMF3 if the packet version is ObjectEncodingAMF3.
+func (e *AMF0Encoder) WritePacket(p *Packet) error {
+	if err := e.WriteUInt16(p.Version); err != nil {
+		return err
+	}
+
+	if len(p.Headers) > math.MaxUint16 {
+		return fmt.Errorf("Too many headers: %d", len(p.Headers))
+	}
+	if err := e.WriteUInt16(uint16(len(p.Headers))); err != nil {
+		return err
+	}
+	for _, h := range p.Headers {
+		if err := e.WriteString(h.Name); err != nil {
+			return err
+		}
+		var mustUnderstand uint8
+		if h.MustUnderstand {
+			mustUnderstand = 1
+		}
+		if err := e.WriteUInt8(mustUnderstand); err != nil {
+			return err
+		}
+		if err := e.writePacketValue(p.Version, h.Value); err != nil {
+			return fmt.Errorf("Cannot write header %s: %v", h.Name, err)
+		}
+	}
+
+	if len(p.Messages) > math.MaxUint16 {
+		return fmt.Errorf("Too many messages: %d", len(p.Messages))
+	}
+	if err := e.WriteUInt16(uint16(len(p.Messages))); err != nil {
+		return err
+	}
+	for _, m := range p.Messages {
+		if err := e.WriteString(m.TargetURI); err != nil {
+			return err
+		}
+		if err := e.WriteString(m.ResponseURI); err != nil {
+			return err
+		}
+		if err := e.writePacketValue(p.Version, m.Value); err != nil {
+			return fmt.Errorf("Cannot write message %s: %v", m.TargetURI, err)
+		}
+	}
+
+	return nil
+}
+
+// writePacketValue writes the length and the value of a header or message.
+// Values are buffered to write their lengths.
+func (e *AMF0Encoder) writePacketValue(version uint16, v interface{}) error {
+	raw, ok := v.(RawValue)
+	if !ok {
+		var err error
+		if raw, err = e.EncodePacketValue(version, v); err != nil {
+			return err
+		}
+	}
+	if err := e.WriteUInt32(uint32(len(raw))); err != nil {
+		return err
+	}
+	_, err := e.writer.Write(raw)
+	return err
+}
+
+// EncodePacketValue encodes v as a header or message value of a packet of
+// version, so that values failing to encode can be replaced before the
+// packet is written.
+func (e *AMF0Encoder) EncodePacketValue(version uint16, v interface{}) (RawValue, error) {
+	buf := &bytes.Buffer{}
+	if err := e.valueEncoder(buf, version).WriteValue(v); err != nil {
+		return nil, err
+	}
+	return RawValue(buf.Bytes()), nil
+}
+
+// valueEncoder returns an encoder to w with the options of e and empty
+// reference tables, writing values in AMF3 for packets of version 3.
+func (e *AMF0Encoder) valueEncoder(w io.Writer, version uint16) *AMF0Encoder {
+	enc := NewAMF0Encoder(w)
+	enc.VerboseLog = e.VerboseLog
+	enc.TraitsMapper = e.TraitsMapper
+	enc.MapsAsArrays = e.MapsAsArrays
+	enc.ObjectVectors = e.ObjectVectors
+	enc.NilSlicesAsEmptyArrays = e.NilSlicesAsEmptyArrays
+	enc.LargeIntegers = e.LargeIntegers
+	if version == ObjectEncodingAMF3 {
+		enc.ObjectEncoding = ObjectEncodingAMF3
+	}
+	return enc
+}
@@ -0,0 +1,40 @@
+package amf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadPacketUnknownLengths(t *testing.T) {
+	data := []byte{
+		0x00, 0x03, // version
+		0x00, 0x01, // header
+		0x00, 0x01, 'h', 0x01,
+		0xff, 0xff, 0xff, 0xff,
+		0x02, 0x00, 0x01, 'v',
+		0x00, 0x02, // messages
+		0x00, 0x01, 'a', 0x00, 0x02, '/', '1',
+		0xff, 0xff, 0xff, 0xff,
+		0x11, 0x09, 0x05, 0x01, 0x06, 0x05, 'a', 'b', 0x06, 0x00,
+		0x00, 0x01, 'b', 0x00, 0x02, '/', '2',
+		0xff, 0xff, 0xff, 0xff,
+		0x00, 0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	p, err := ReadPacket(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Version != ObjectEncodingAMF3 || len(p.Headers) != 1 || len(p.Messages) != 2 {
+		t.Fatalf("Read %+v", p)
+	}
+	if h := p.Headers[0]; h.Name != "h" || !h.MustUnderstand || h.Value != "v" {
+		t.Errorf("Header %+v", h)
+	}
+	m := p.Messages[0]
+	if arr, ok := m.Value.([]interface{}); m.TargetURI != "a" || m.ResponseURI != "/1" || !ok || len(arr) != 2 || arr[1] != "ab" {
+		t.Errorf("Message %+v", m)
+	}
+	if m := p.Messages[1]; m.TargetURI != "b" || m.ResponseURI != "/2" || m.Value != float64(2) {
+		t.Errorf("Message %+v", m)
+	}
+}
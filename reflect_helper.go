@@ -2,12 +2,36 @@ package amf
 
 import (
 	"fmt"
+	"math"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func setReflectValue(dst reflect.Value, srcif interface{}) error {
 	src := reflect.ValueOf(srcif)
+	if !src.IsValid() {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+	// References are kept as pointers to the decoded objects, dereference
+	// them for value targets. Slices are always given by value.
+	if src.Kind() == reflect.Ptr && !src.IsNil() {
+		elemType := src.Type().Elem()
+		if (!src.Type().AssignableTo(dst.Type()) && elemType.AssignableTo(dst.Type())) ||
+			(elemType.Kind() == reflect.Slice && dst.Kind() == reflect.Interface) {
+			src = src.Elem()
+			srcif = src.Interface()
+		}
+	}
+	if dst.Kind() == reflect.Ptr && !src.Type().AssignableTo(dst.Type()) {
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return setReflectValue(dst.Elem(), srcif)
+	}
 	if !src.Type().AssignableTo(dst.Type()) {
 		if src.Type().ConvertibleTo(dst.Type()) {
 			src = src.Convert(dst.Type())
@@ -19,27 +43,153 @@ func setReflectValue(dst reflect.Value, srcif interface{}) error {
 	return nil
 }
 
-func createReflectObject(v reflect.Value, defaultType reflect.Type) error {
-	//fmt.Println("createReflectObject", "v.Type()", v.Type(), "defaultType", defaultType)
-	if !v.CanSet() {
-		panic("v is not settable")
-		//return fmt.Errorf("v is not settable")
+// setReflectUndefined sets undefined to dst, interfaces receive a
+// *AMF3Undefined. Concrete types are set to zero value like null.
+func setReflectUndefined(dst reflect.Value) error {
+	if dst.Kind() == reflect.Interface || reflectRemoveTypePtrs(dst.Type()) == reflect.TypeOf(Undefined) {
+		return setReflectValue(dst, &AMF3Undefined{})
 	}
-	switch v.Kind() {
-	case reflect.Slice:
-		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	dst.Set(reflect.Zero(dst.Type()))
+	return nil
+}
+
+// RangeError is returned when a number cannot be represented by the
+// destination type.
+type RangeError struct {
+	Value interface{}
+	Type  reflect.Type
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("Value %v cannot be represented by type %s", e.Value, e.Type)
+}
+
+// setReflectInt sets an integer to an integer or floating point value,
+// failing with RangeError instead of wrapping around.
+func setReflectInt(dst reflect.Value, i int64) error {
+	switch dst.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if dst.OverflowInt(i) {
+			return &RangeError{i, dst.Type()}
+		}
+		dst.SetInt(i)
 		return nil
-	case reflect.Map:
-		v.Set(reflect.MakeMap(v.Type()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i < 0 || dst.OverflowUint(uint64(i)) {
+			return &RangeError{i, dst.Type()}
+		}
+		dst.SetUint(uint64(i))
 		return nil
-	case reflect.Ptr:
-		v.Set(reflect.New(v.Type().Elem()))
+	case reflect.Float32, reflect.Float64:
+		dst.SetFloat(float64(i))
 		return nil
+	case reflect.Ptr:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return setReflectInt(dst.Elem(), i)
 	case reflect.Interface:
-		v.Set(reflect.New(reflectRemoveTypePtrs(defaultType)))
+		return setReflectValue(dst, int32(i))
+	default:
+		// Converting would turn integers into strings of a rune
+		return fmt.Errorf("Cannot set type %s to %s", reflect.Int32, dst.Kind())
+	}
+}
+
+const (
+	twoTo63 = 1 << 63
+	twoTo64 = 1 << 64
+)
+
+// intToDouble converts i to a double and tells whether it is exact.
+func intToDouble(i int64) (f float64, exact bool) {
+	f = float64(i)
+	// 1<<63 does not convert back to int64
+	return f, f != twoTo63 && int64(f) == i
+}
+
+// uintToDouble converts i to a double and tells whether it is exact.
+func uintToDouble(i uint64) (f float64, exact bool) {
+	f = float64(i)
+	return f, f != twoTo64 && uint64(f) == i
+}
+
+// timeToMillis converts t to milliseconds since the epoch, the precision
+// dates are sent with.
+func timeToMillis(t time.Time) float64 {
+	return float64(t.Unix()*1000 + int64(t.Nanosecond()/int(time.Millisecond)))
+}
+
+// millisToTime converts milliseconds since the epoch to time.Time.
+func millisToTime(f float64) time.Time {
+	msecs := int64(f)
+	nsecs := 1e6*(msecs%1000) + int64(1e6*(f-float64(msecs)))
+	return time.Unix(msecs/1000, nsecs)
+}
+
+// setReflectFloat sets a double to a numeric value. Integers only accept
+// doubles of integral value in their range.
+func setReflectFloat(dst reflect.Value, f float64) error {
+	switch dst.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if f != math.Trunc(f) || f < -twoTo63 || f >= twoTo63 || dst.OverflowInt(int64(f)) {
+			return &RangeError{f, dst.Type()}
+		}
+		dst.SetInt(int64(f))
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if f != math.Trunc(f) || f < 0 || f >= twoTo64 || dst.OverflowUint(uint64(f)) {
+			return &RangeError{f, dst.Type()}
+		}
+		dst.SetUint(uint64(f))
+		return nil
+	case reflect.Float32, reflect.Float64:
+		if dst.OverflowFloat(f) {
+			return &RangeError{f, dst.Type()}
+		}
+		dst.SetFloat(f)
 		return nil
+	case reflect.Ptr:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return setReflectFloat(dst.Elem(), f)
 	default:
-		return setReflectValue(v, reflect.New(defaultType).Elem().Interface())
+		return setReflectValue(dst, f)
+	}
+}
+
+// setReflectNumericString parses a decimal string into an integer value.
+// Other kinds are set the string as is.
+func setReflectNumericString(dst reflect.Value, str string) error {
+	switch dst.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(str, 10, dst.Type().Bits())
+		if err != nil {
+			if err.(*strconv.NumError).Err == strconv.ErrRange {
+				return &RangeError{str, dst.Type()}
+			}
+			return err
+		}
+		dst.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, err := strconv.ParseUint(str, 10, dst.Type().Bits())
+		if err != nil {
+			if err.(*strconv.NumError).Err == strconv.ErrRange {
+				return &RangeError{str, dst.Type()}
+			}
+			return err
+		}
+		dst.SetUint(u)
+		return nil
+	case reflect.Ptr:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return setReflectNumericString(dst.Elem(), str)
+	default:
+		return setReflectValue(dst, str)
 	}
 }
 
@@ -50,61 +200,153 @@ func reflectRemoveTypePtrs(t reflect.Type) reflect.Type {
 	return t
 }
 
-func reflectResolveType(dstKind reflect.Kind, src reflect.Value) reflect.Value {
+// sortedMapKeys returns the keys of a map in sorted order, so that maps are
+// written the same way each time. Keys of different kinds are ordered by
+// kind, keys which have no order such as pointers are left as found.
+func sortedMapKeys(v reflect.Value) []reflect.Value {
+	keys := v.MapKeys()
+	sort.Stable(mapKeys(keys))
+	return keys
+}
+
+type mapKeys []reflect.Value
+
+func (s mapKeys) Len() int           { return len(s) }
+func (s mapKeys) Less(i, j int) bool { return mapKeyLess(s[i], s[j]) }
+func (s mapKeys) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func mapKeyLess(a, b reflect.Value) bool {
+	if a.Kind() == reflect.Interface {
+		a = a.Elem()
+	}
+	if b.Kind() == reflect.Interface {
+		b = b.Elem()
+	}
 	switch {
-	case dstKind == reflect.Ptr && src.Kind() != reflect.Ptr:
-		return src.Addr()
-	case dstKind != reflect.Ptr && src.Kind() == reflect.Ptr:
-		return src.Elem()
-	default:
-		return src
+	case !a.IsValid() || !b.IsValid():
+		return !a.IsValid() && b.IsValid()
+	case a.Kind() != b.Kind():
+		return a.Kind() < b.Kind()
+	}
+
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() < b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() < b.Float()
+	case reflect.String:
+		return a.String() < b.String()
+	case reflect.Bool:
+		return !a.Bool() && b.Bool()
+	}
+	return false
+}
+
+// isMemberKeyType tells whether member names can be keys of type tp.
+func isMemberKeyType(tp reflect.Type) bool {
+	return tp.Kind() == reflect.String || reflect.TypeOf("").AssignableTo(tp)
+}
+
+// checkMembersTarget returns an error unless the members of an object can be
+// read into type tp, a struct or a map with string keys.
+func checkMembersTarget(tp reflect.Type) error {
+	switch tp.Kind() {
+	case reflect.Struct:
+		return nil
+	case reflect.Map:
+		if isMemberKeyType(tp.Key()) {
+			return nil
+		}
 	}
+	return fmt.Errorf("Cannot read object members into %s", tp)
 }
 
+// findFieldByName finds the field to decode name into. Nil embedded struct
+// pointers are allocated if they have the field.
 func findFieldByName(v reflect.Value, name string) reflect.Value {
-	name = strings.ToLower(name)
+	field, _ := lookupStructField(v, strings.ToLower(name), true)
+	return field
+}
+
+// findStructFieldByName finds the field of name to encode. Fields of nil
+// embedded struct pointers are not found.
+func findStructFieldByName(v reflect.Value, name string) (reflect.Value, reflect.StructField) {
+	return lookupStructField(v, strings.ToLower(name), false)
+}
+
+func lookupStructField(v reflect.Value, name string, alloc bool) (reflect.Value, reflect.StructField) {
 	tp := v.Type()
 	for i, n := 0, tp.NumField(); i < n; i++ {
 		sf := tp.Field(i)
 		if sf.PkgPath != "" {
 			continue
 		}
-		if strings.ToLower(sf.Name) == name || sf.Tag.Get("amf3") == name {
-			return v.Field(i)
+		if strings.ToLower(sf.Name) == name || strings.ToLower(sf.Tag.Get("amf3")) == name {
+			return v.Field(i), sf
 		}
-		if sf.Anonymous {
-			if field := findFieldByName(v.Field(i), name); field.IsValid() {
-				return field
+		if !sf.Anonymous {
+			continue
+		}
+
+		embedded := v.Field(i)
+		if embedded.Kind() == reflect.Ptr && embedded.Type().Elem().Kind() == reflect.Struct {
+			if embedded.IsNil() {
+				if !alloc || !embedded.CanSet() {
+					continue
+				}
+				// Only keep the allocation if the field is there
+				ptr := reflect.New(embedded.Type().Elem())
+				if field, fsf := lookupStructField(ptr.Elem(), name, alloc); field.IsValid() {
+					embedded.Set(ptr)
+					return field, fsf
+				}
+				continue
+			}
+			embedded = embedded.Elem()
+		}
+		if embedded.Kind() == reflect.Struct {
+			if field, fsf := lookupStructField(embedded, name, alloc); field.IsValid() {
+				return field, fsf
 			}
 		}
 	}
-	return reflect.ValueOf(nil)
+	return reflect.ValueOf(nil), reflect.StructField{}
 }
 
 func getStructMembersAndDynamics(v reflect.Value) (members []string, dynamics []string) {
-	return appendStructMembersAndDynamics(v, nil, nil)
+	return appendStructMembersAndDynamics(v.Type(), nil, nil)
 }
 
-func appendStructMembersAndDynamics(v reflect.Value, members []string, dynamics []string) ([]string, []string) {
-	tp := v.Type()
+// appendStructMembersAndDynamics lists the fields of type tp, so that values
+// with nil embedded pointers have the same members.
+func appendStructMembersAndDynamics(tp reflect.Type, members []string, dynamics []string) ([]string, []string) {
 	for i, n := 0, tp.NumField(); i < n; i++ {
 		sf := tp.Field(i)
 		if sf.PkgPath != "" {
 			continue
 		}
 		if sf.Anonymous {
-			members, dynamics = appendStructMembersAndDynamics(v.Field(i), members, dynamics)
-		} else {
-			name := sf.Tag.Get("amf3")
-			if name == "" {
-				name = sf.Name
+			embedded := sf.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
 			}
-			if sf.Tag.Get("amf3_dynamic") == "" {
-				members = append(members, name)
-			} else {
-				dynamics = append(dynamics, name)
+			if embedded.Kind() == reflect.Struct {
+				members, dynamics = appendStructMembersAndDynamics(embedded, members, dynamics)
+				continue
 			}
 		}
+
+		name := sf.Tag.Get("amf3")
+		if name == "" {
+			name = sf.Name
+		}
+		if sf.Tag.Get("amf3_dynamic") == "" {
+			members = append(members, name)
+		} else {
+			dynamics = append(dynamics, name)
+		}
 	}
 	return members, dynamics
 }
@@ -2,12 +2,20 @@ package amf
 
 import (
 	"fmt"
+	"reflect"
 )
 
 type refTable []interface{}
 
+// refAlias is an entry standing for the entry at its index, such as a proxy
+// object while the value it wraps is read.
+type refAlias int
+
 func (r *refTable) Get(i int) (interface{}, error) {
 	if i >= 0 && i < len(*r) {
+		if alias, ok := (*r)[i].(refAlias); ok {
+			return r.Get(int(alias))
+		}
 		return (*r)[i], nil
 	}
 	return nil, fmt.Errorf("refTable index out-of-bounds: %d, len: %d", i, len(*r))
@@ -17,11 +25,78 @@ func (r *refTable) Add(v interface{}) {
 	*r = append(*r, v)
 }
 
-func (r *refTable) Reserve() *interface{} {
+// Reserve adds an empty slot and returns its index, to be filled with Set.
+func (r *refTable) Reserve() int {
 	*r = append(*r, nil)
-	return &(*r)[len(*r)-1]
+	return len(*r) - 1
+}
+
+func (r *refTable) Set(i int, v interface{}) {
+	(*r)[i] = v
 }
 
 func (r *refTable) Len() int {
 	return len(*r)
 }
+
+// objectRefIndex is the object reference table of encoders. Objects written
+// before are found by their identity.
+type objectRefIndex struct {
+	refTable
+	keys map[interface{}]int
+}
+
+// objectRefKey identifies an object by its type, address and the marker it
+// was written with.
+type objectRefKey struct {
+	marker uint8
+	tp     reflect.Type
+	ptr    uintptr
+	len    int
+}
+
+// getObjectRefKey returns the key identifying the object of v, or nil if v
+// has no identity. Empty slices and zero-size values may share their address
+// with other objects, so they have no identity either.
+func getObjectRefKey(marker uint8, v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Pointer() != 0 {
+			return objectRefKey{marker, v.Type(), v.Pointer(), 0}
+		}
+	case reflect.Slice:
+		if v.Pointer() != 0 && v.Len() > 0 && v.Type().Elem().Size() > 0 {
+			return objectRefKey{marker, v.Type(), v.Pointer(), v.Len()}
+		}
+	default:
+		if v.CanAddr() && v.Type().Size() > 0 {
+			return objectRefKey{marker, v.Type(), v.Addr().Pointer(), 0}
+		}
+	}
+	return nil
+}
+
+// findOrAdd returns the reference index of the object of v if it has been
+// written before with the same marker, and the index is at most maxRef.
+// Otherwise v is added to the table. Values without identity are always
+// added.
+func (r *objectRefIndex) findOrAdd(marker uint8, v reflect.Value, maxRef int) (int, bool) {
+	if key := getObjectRefKey(marker, v); key != nil {
+		if ref, ok := r.keys[key]; ok && ref <= maxRef {
+			return ref, true
+		}
+		if r.keys == nil {
+			r.keys = make(map[interface{}]int)
+		}
+		r.keys[key] = r.Len()
+	}
+
+	if v.CanAddr() {
+		r.Add(v.Addr().Interface())
+	} else if v.IsValid() {
+		r.Add(v.Interface())
+	} else {
+		r.Add(nil)
+	}
+	return -1, false
+}